@@ -0,0 +1,96 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2020 Ryan Fowler
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package distcache
+
+import (
+	"math/rand"
+	"sync"
+
+	"github.com/ryanfowler/distcache/internal/sketch"
+)
+
+// AdmissionPolicy decides whether values retrieved from peers are added to
+// the hot store.
+type AdmissionPolicy interface {
+	// Record is called every time that key is requested from the cache.
+	Record(key string)
+	// Admit returns true if the value for key should be added to the hot
+	// store.
+	Admit(key string) bool
+}
+
+// AlwaysAdmit returns an AdmissionPolicy that admits every key.
+func AlwaysAdmit() AdmissionPolicy {
+	return alwaysAdmit{}
+}
+
+type alwaysAdmit struct{}
+
+func (alwaysAdmit) Record(string)     {}
+func (alwaysAdmit) Admit(string) bool { return true }
+
+// RandomAdmission returns an AdmissionPolicy that admits keys with the
+// provided probability, regardless of how often they're requested.
+func RandomAdmission(probability float64) AdmissionPolicy {
+	return randomAdmission(probability)
+}
+
+type randomAdmission float64
+
+func (randomAdmission) Record(string) {}
+
+func (p randomAdmission) Admit(string) bool {
+	return rand.Float64() < float64(p) //nolint:gosec
+}
+
+// FrequencyThreshold returns an AdmissionPolicy that admits keys that have
+// been requested at least minCount times recently. Frequencies are estimated
+// using a count-min sketch sized for roughly size distinct keys, and decay over
+// time so that keys that are no longer popular stop being admitted. The sketch
+// counts up to 15, so larger values of minCount are treated as 15.
+func FrequencyThreshold(size, minCount int) AdmissionPolicy {
+	return &frequencyThreshold{
+		sketch:   sketch.New(size),
+		minCount: min(minCount, sketch.MaxCount),
+	}
+}
+
+type frequencyThreshold struct {
+	mu       sync.Mutex
+	sketch   *sketch.CountMin
+	minCount int
+}
+
+func (t *frequencyThreshold) Record(key string) {
+	h := t.sketch.Hash(key)
+	t.mu.Lock()
+	t.sketch.Add(h)
+	t.mu.Unlock()
+}
+
+func (t *frequencyThreshold) Admit(key string) bool {
+	h := t.sketch.Hash(key)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.sketch.Estimate(h) >= t.minCount
+}
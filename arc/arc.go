@@ -0,0 +1,261 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2020 Ryan Fowler
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+// Package arc implements a byte-budgeted store using the Adaptive Replacement
+// Cache (ARC) eviction policy.
+package arc
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"time"
+
+	"github.com/ryanfowler/distcache"
+)
+
+var _ distcache.Store = (*ARC)(nil)
+
+type listID int
+
+const (
+	// t1 holds values accessed once recently, and t2 values accessed at
+	// least twice.
+	t1 listID = iota
+	t2
+	// b1 and b2 hold the keys of values recently evicted from t1 and t2.
+	b1
+	b2
+)
+
+// ARC is a store that splits its budget between values accessed once
+// recently and values accessed repeatedly, adapting the split based on which
+// of the two would have avoided recent misses. Values that are only read
+// once, such as by scans, are confined to the first of the two lists.
+type ARC struct {
+	maxBytes int
+	now      func() time.Time
+
+	mu        sync.Mutex
+	target    int
+	lists     [4]*list.List
+	sizes     [4]int
+	evictions uint64
+	entries   map[string]*entry
+}
+
+// entry is a value in t1 or t2, or the key of an evicted value in b1 or b2.
+type entry struct {
+	key     string
+	val     []byte
+	size    int
+	expires time.Time
+	list    listID
+	elem    *list.Element
+}
+
+func (e *entry) expired(now time.Time) bool {
+	return !e.expires.IsZero() && !now.Before(e.expires)
+}
+
+// New returns an ARC that holds up to maxBytes of keys and values.
+func New(maxBytes int) *ARC {
+	a := &ARC{
+		maxBytes: maxBytes,
+		now:      time.Now,
+		entries:  make(map[string]*entry),
+	}
+	for i := range a.lists {
+		a.lists[i] = list.New()
+	}
+	return a
+}
+
+func (a *ARC) Get(ctx context.Context, key string) ([]byte, time.Duration, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	e, ok := a.entries[key]
+	if !ok || !e.resident() {
+		return nil, 0, nil
+	}
+	var ttl time.Duration
+	if !e.expires.IsZero() {
+		now := a.now()
+		if e.expired(now) {
+			a.remove(e)
+			return nil, 0, nil
+		}
+		ttl = e.expires.Sub(now)
+	}
+	a.move(e, t2)
+	return e.val, ttl, nil
+}
+
+func (a *ARC) Len() int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.lists[t1].Len() + a.lists[t2].Len()
+}
+
+func (a *ARC) Size() int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.sizes[t1] + a.sizes[t2]
+}
+
+// Evictions returns the number of values that have been evicted to stay
+// within maxBytes.
+func (a *ARC) Evictions() uint64 {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.evictions
+}
+
+// Range calls fn for each value, from the most recently used values accessed
+// repeatedly to the least recently used values accessed once.
+func (a *ARC) Range(fn func(key string, val []byte) bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	now := a.now()
+	for _, id := range []listID{t2, t1} {
+		for el := a.lists[id].Front(); el != nil; el = el.Next() {
+			e := el.Value.(*entry)
+			if e.expired(now) {
+				continue
+			}
+			if !fn(e.key, e.val) {
+				return
+			}
+		}
+	}
+}
+
+func (a *ARC) Set(ctx context.Context, key string, val []byte, ttl time.Duration) error {
+	if val == nil {
+		return nil
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	e, ok := a.entries[key]
+	size := len(key) + len(val)
+	if ttl < 0 || size > a.maxBytes {
+		// The value has already expired, or can never fit.
+		if ok {
+			a.remove(e)
+		}
+		return nil
+	}
+
+	var expires time.Time
+	if ttl > 0 {
+		expires = a.now().Add(ttl)
+	}
+
+	switch {
+	case ok && e.resident():
+		a.sizes[e.list] += size - e.size
+		e.val, e.size, e.expires = val, size, expires
+		a.move(e, t2)
+		a.replace(0, false)
+	case ok:
+		// A ghost hit: grow the list that would have kept the value.
+		inB2 := e.list == b2
+		if inB2 {
+			a.target = max(a.target-size*max(1, a.sizes[b1]/max(a.sizes[b2], 1)), 0)
+		} else {
+			a.target = min(a.target+size*max(1, a.sizes[b2]/max(a.sizes[b1], 1)), a.maxBytes)
+		}
+		a.unlink(e)
+		a.replace(size, inB2)
+		e.val, e.size, e.expires = val, size, expires
+		a.push(e, t2)
+	default:
+		a.replace(size, false)
+		a.trimGhosts(size)
+		e = &entry{key: key, val: val, size: size, expires: expires}
+		a.push(e, t1)
+		a.entries[key] = e
+	}
+	return nil
+}
+
+func (a *ARC) Delete(ctx context.Context, key string) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if e, ok := a.entries[key]; ok {
+		a.remove(e)
+	}
+	return nil
+}
+
+// replace evicts values from t1 or t2 to their ghost lists until there's room
+// for size more bytes, preferring t1 while it's larger than the target.
+func (a *ARC) replace(size int, inB2 bool) {
+	for a.sizes[t1]+a.sizes[t2]+size > a.maxBytes {
+		from, to := t2, b2
+		if a.lists[t1].Len() > 0 && (a.sizes[t1] > a.target || (inB2 && a.sizes[t1] == a.target) || a.lists[t2].Len() == 0) {
+			from, to = t1, b1
+		}
+		e := a.lists[from].Back().Value.(*entry)
+		a.move(e, to)
+		e.val = nil
+		a.evictions++
+	}
+}
+
+// trimGhosts forgets evicted keys so that t1 and b1 together, and all lists
+// together, stay within the bounds ARC keeps on its history.
+func (a *ARC) trimGhosts(size int) {
+	for a.sizes[t1]+a.sizes[b1]+size > a.maxBytes && a.lists[b1].Len() > 0 {
+		a.remove(a.lists[b1].Back().Value.(*entry))
+	}
+	for a.sizes[t1]+a.sizes[t2]+a.sizes[b1]+a.sizes[b2]+size > 2*a.maxBytes && a.lists[b2].Len() > 0 {
+		a.remove(a.lists[b2].Back().Value.(*entry))
+	}
+}
+
+func (e *entry) resident() bool {
+	return e.list == t1 || e.list == t2
+}
+
+func (a *ARC) move(e *entry, id listID) {
+	a.unlink(e)
+	a.push(e, id)
+}
+
+func (a *ARC) push(e *entry, id listID) {
+	e.list = id
+	e.elem = a.lists[id].PushFront(e)
+	a.sizes[id] += e.size
+}
+
+func (a *ARC) unlink(e *entry) {
+	a.lists[e.list].Remove(e.elem)
+	a.sizes[e.list] -= e.size
+}
+
+func (a *ARC) remove(e *entry) {
+	a.unlink(e)
+	delete(a.entries, e.key)
+}
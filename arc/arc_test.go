@@ -0,0 +1,89 @@
+package arc
+
+import (
+	"context"
+	"strconv"
+	"testing"
+)
+
+// set adds a 100 byte entry for key, which must be 2 bytes long.
+func set(a *ARC, key string) {
+	_ = a.Set(context.Background(), key, make([]byte, 98), 0)
+}
+
+func TestARCGhostHits(t *testing.T) {
+	ctx := context.Background()
+	a := New(1000)
+	for i := 0; i < 10; i++ {
+		set(a, "k"+strconv.Itoa(i))
+	}
+	_, _, _ = a.Get(ctx, "k0")
+	_, _, _ = a.Get(ctx, "k1")
+	if a.entries["k0"].list != t2 || a.entries["k2"].list != t1 {
+		t.Fatal("expected values accessed twice to move to t2")
+	}
+
+	// t1 is larger than the target, so it's evicted from first.
+	set(a, "ka")
+	if e := a.entries["k2"]; e.list != b1 || e.val != nil {
+		t.Fatalf("expected k2 to be evicted to b1: %+v", e)
+	}
+	if a.Len() != 10 || a.Size() != 1000 {
+		t.Fatalf("unexpected len %d, size %d", a.Len(), a.Size())
+	}
+
+	// A hit in b1 grows the target for t1, and readmits the value to t2.
+	set(a, "k2")
+	if a.target != 100 {
+		t.Fatalf("unexpected target after b1 hit: %d", a.target)
+	}
+	if e := a.entries["k2"]; e.list != t2 || e.val == nil {
+		t.Fatalf("expected k2 to be readmitted to t2: %+v", e)
+	}
+
+	// Once t1 is within its target, t2 is evicted from instead.
+	a.target = a.maxBytes
+	set(a, "kb")
+	if e := a.entries["k0"]; e.list != b2 {
+		t.Fatalf("expected k0 to be evicted to b2: %+v", e)
+	}
+
+	// A hit in b2 shrinks the target for t1.
+	set(a, "k0")
+	if a.target != a.maxBytes-100 {
+		t.Fatalf("unexpected target after b2 hit: %d", a.target)
+	}
+	if e := a.entries["k0"]; e.list != t2 {
+		t.Fatalf("expected k0 to be readmitted to t2: %+v", e)
+	}
+}
+
+func TestARCTrimGhosts(t *testing.T) {
+	ctx := context.Background()
+	a := New(1000)
+	for i := 0; i < 5; i++ {
+		key := "k" + strconv.Itoa(i)
+		set(a, key)
+		_, _, _ = a.Get(ctx, key)
+	}
+
+	// A scan of unique keys only churns t1, and the ghost lists stay within
+	// their bounds.
+	for i := 10; i < 100; i++ {
+		set(a, strconv.Itoa(i))
+		if a.sizes[t1]+a.sizes[b1] > a.maxBytes {
+			t.Fatalf("t1 and b1 exceed budget: %d", a.sizes[t1]+a.sizes[b1])
+		}
+		if total := a.sizes[t1] + a.sizes[t2] + a.sizes[b1] + a.sizes[b2]; total > 2*a.maxBytes {
+			t.Fatalf("lists exceed twice the budget: %d", total)
+		}
+	}
+	for i := 0; i < 5; i++ {
+		if val, _, _ := a.Get(ctx, "k"+strconv.Itoa(i)); val == nil {
+			t.Fatalf("expected k%d to survive the scan", i)
+		}
+	}
+	if n := len(a.entries); n != a.lists[t1].Len()+a.lists[t2].Len()+a.lists[b1].Len()+a.lists[b2].Len() {
+		t.Fatalf("entries out of sync with lists: %d", n)
+	}
+}
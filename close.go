@@ -0,0 +1,78 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2020 Ryan Fowler
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package distcache
+
+import (
+	"context"
+	"errors"
+	"io"
+)
+
+// ErrClosed is returned by a Cache after it has been closed.
+var ErrClosed = errors.New("cache closed")
+
+// Close stops the cache from starting new loads, waits for in-flight loads to
+// finish, and closes all peers once their in-flight requests finish. If
+// Options.CloseStores is set, the hot and local stores are also closed if
+// they implement io.Closer. If ctx is done first, Close returns without
+// waiting any longer.
+func (c *Cache) Close(ctx context.Context) error {
+	if !c.closed.CompareAndSwap(false, true) {
+		return ErrClosed
+	}
+
+	err := errors.Join(c.single.close(ctx), c.refreshing.close(ctx))
+
+	c.muSetPeers.Lock()
+	if c.cancelHandoff != nil {
+		c.cancelHandoff()
+	}
+	c.mu.Lock()
+	peers := c.peers
+	c.peers = nil
+	c.mu.Unlock()
+	for addr, peer := range peers {
+		c.drainPeer(addr, peer)
+	}
+	c.muSetPeers.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		c.draining.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		err = errors.Join(err, ctx.Err())
+	}
+
+	if c.closeStores {
+		for _, store := range []Store{c.hotStore, c.localStore} {
+			if closer, ok := store.(io.Closer); ok {
+				err = errors.Join(err, closer.Close())
+			}
+		}
+	}
+	return err
+}
@@ -0,0 +1,240 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2020 Ryan Fowler
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package distcache
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// Compressor compresses and decompresses values. Name identifies the format
+// when negotiating compression with peers.
+type Compressor interface {
+	Name() string
+	Compress(src []byte) ([]byte, error)
+	Decompress(src []byte) ([]byte, error)
+}
+
+// Gzip returns a Compressor using the gzip format at the provided level.
+func Gzip(level int) Compressor {
+	c := &gzipCompressor{level: level}
+	c.writers.New = func() any {
+		w, _ := gzip.NewWriterLevel(nil, level)
+		return w
+	}
+	return c
+}
+
+type gzipCompressor struct {
+	level   int
+	writers sync.Pool
+}
+
+func (c *gzipCompressor) Name() string {
+	return "gzip"
+}
+
+func (c *gzipCompressor) Compress(src []byte) ([]byte, error) {
+	if c.level < gzip.HuffmanOnly || c.level > gzip.BestCompression {
+		return nil, fmt.Errorf("gzip: invalid compression level: %d", c.level)
+	}
+	var buf bytes.Buffer
+	w := c.writers.Get().(*gzip.Writer)
+	defer c.writers.Put(w)
+	w.Reset(&buf)
+	if _, err := w.Write(src); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (c *gzipCompressor) Decompress(src []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(src))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
+
+// Flate returns a Compressor using the raw DEFLATE format at the provided
+// level.
+func Flate(level int) Compressor {
+	c := &flateCompressor{level: level}
+	c.writers.New = func() any {
+		w, _ := flate.NewWriter(nil, level)
+		return w
+	}
+	return c
+}
+
+type flateCompressor struct {
+	level   int
+	writers sync.Pool
+}
+
+func (c *flateCompressor) Name() string {
+	return "deflate"
+}
+
+func (c *flateCompressor) Compress(src []byte) ([]byte, error) {
+	if c.level < flate.HuffmanOnly || c.level > flate.BestCompression {
+		return nil, fmt.Errorf("flate: invalid compression level: %d", c.level)
+	}
+	var buf bytes.Buffer
+	w := c.writers.Get().(*flate.Writer)
+	defer c.writers.Put(w)
+	w.Reset(&buf)
+	if _, err := w.Write(src); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (c *flateCompressor) Decompress(src []byte) ([]byte, error) {
+	r := flate.NewReader(bytes.NewReader(src))
+	defer r.Close()
+	return io.ReadAll(r)
+}
+
+// Compress returns src compressed with c if it's at least minSize bytes and
+// compressing makes it smaller, along with whether it was compressed.
+func Compress(c Compressor, src []byte, minSize int) ([]byte, bool, error) {
+	if len(src) < minSize || len(src) == 0 {
+		return src, false, nil
+	}
+	dst, err := c.Compress(src)
+	if err != nil {
+		return nil, false, err
+	}
+	if len(dst) >= len(src) {
+		return src, false, nil
+	}
+	return dst, true, nil
+}
+
+// CompressionOptions configures a compressed Store.
+type CompressionOptions struct {
+	// Compressor compresses values. Defaults to Gzip(gzip.DefaultCompression).
+	Compressor Compressor
+
+	// MinSize is the size in bytes below which values are stored raw.
+	MinSize int
+}
+
+// Values stored by a compressed Store are prefixed with a byte recording how
+// they were stored.
+const (
+	compressedRaw byte = iota
+	compressedValue
+)
+
+var errInvalidCompressedValue = errors.New("invalid compressed value")
+
+// CompressedStore returns a Store that compresses the values stored in store,
+// so that the store accounts for their compressed size. The returned Store
+// only implements Ranger, yielding decompressed values, and io.Closer when
+// store does.
+func CompressedStore(store Store, opts CompressionOptions) Store {
+	if opts.Compressor == nil {
+		opts.Compressor = Gzip(gzip.DefaultCompression)
+	}
+	cs := &compressedStore{store: store, compressor: opts.Compressor, minSize: opts.MinSize}
+	return wrapStore(store, cs, cs.rangeValues)
+}
+
+type compressedStore struct {
+	store      Store
+	compressor Compressor
+	minSize    int
+}
+
+func (cs *compressedStore) Get(ctx context.Context, key string) ([]byte, time.Duration, error) {
+	val, ttl, err := cs.store.Get(ctx, key)
+	if err != nil || val == nil {
+		return val, ttl, err
+	}
+	val, err = cs.decode(val)
+	return val, ttl, err
+}
+
+func (cs *compressedStore) Set(ctx context.Context, key string, val []byte, ttl time.Duration) error {
+	if val == nil {
+		return nil
+	}
+	data, compressed, err := Compress(cs.compressor, val, cs.minSize)
+	if err != nil {
+		return err
+	}
+	flag := compressedRaw
+	if compressed {
+		flag = compressedValue
+	}
+	out := make([]byte, 0, len(data)+1)
+	out = append(out, flag)
+	out = append(out, data...)
+	return cs.store.Set(ctx, key, out, ttl)
+}
+
+func (cs *compressedStore) Delete(ctx context.Context, key string) error {
+	return cs.store.Delete(ctx, key)
+}
+
+// rangeValues calls fn with the decompressed value of each entry in the
+// underlying Ranger, skipping values that fail to decompress.
+func (cs *compressedStore) rangeValues(fn func(key string, val []byte) bool) {
+	cs.store.(Ranger).Range(func(key string, val []byte) bool {
+		val, err := cs.decode(val)
+		if err != nil {
+			return true
+		}
+		return fn(key, val)
+	})
+}
+
+func (cs *compressedStore) decode(val []byte) ([]byte, error) {
+	if len(val) == 0 {
+		return nil, errInvalidCompressedValue
+	}
+	switch val[0] {
+	case compressedRaw:
+		return val[1:], nil
+	case compressedValue:
+		return cs.compressor.Decompress(val[1:])
+	default:
+		return nil, errInvalidCompressedValue
+	}
+}
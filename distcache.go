@@ -24,9 +24,13 @@ package distcache
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"io"
-	"math/rand"
+	"slices"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"golang.org/x/sync/singleflight"
 )
@@ -39,12 +43,37 @@ type Cache struct {
 
 	getter      Getter
 	peerCreator PeerCreator
-
-	single singleflight.Group
-
-	mu    sync.Mutex
-	hash  *peerHash
-	peers map[string]Peer
+	admission   AdmissionPolicy
+	observer    Observer
+	tracer      Tracer
+
+	softTTL      time.Duration
+	staleTTL     time.Duration
+	refreshAhead time.Duration
+	notFoundTTL  time.Duration
+
+	single     flightGroup
+	refreshing flightGroup
+
+	newPicker Picker
+
+	mu        sync.Mutex
+	picker    PeerPicker
+	peers     peerMap
+	peerInfos []PeerInfo
+
+	replicas      int
+	handoffBytes  int
+	handoffRate   int
+	cancelHandoff context.CancelFunc
+	drainTimeout  time.Duration
+	draining      sync.WaitGroup
+	closeStores   bool
+	ejection      Ejection
+	hedging       Hedging
+	hedgeBudget   *hedgeBudget
+	closed        atomic.Bool
+	deletions     deletions
 
 	muSetPeers sync.Mutex
 }
@@ -56,133 +85,443 @@ type Options struct {
 	Getter      Getter
 	PeerCreator PeerCreator
 	Peers       []string
+	// PeerInfos, if set, is used instead of Peers to set weighted peers.
+	PeerInfos []PeerInfo
+
+	// Picker chooses the peer that owns each key, and must be the same on
+	// every node. Defaults to Ring(32, CRC32).
+	Picker Picker
+
+	// Admission decides which values retrieved from peers are added to the
+	// hot store. Defaults to RandomAdmission(0.2).
+	Admission AdmissionPolicy
+
+	// Observer, if set, receives events from the cache.
+	Observer Observer
+
+	// Tracer, if set, creates spans for each stage of retrieving keys.
+	Tracer Tracer
+
+	// SoftTTL is how long values are fresh for when the Getter doesn't
+	// return a TTL.
+	SoftTTL time.Duration
+	// HardTTL is how long values can be served for. Once a value is no
+	// longer fresh, it continues to be served with ResultStale for
+	// HardTTL-SoftTTL while it is refreshed in the background. This window
+	// also applies to values whose TTL was returned by the Getter.
+	HardTTL time.Duration
+	// RefreshAhead, if non-zero, causes fresh values that are read within
+	// RefreshAhead of becoming stale to be refreshed in the background.
+	// Values that aren't read in that window are left to expire, so only
+	// frequently read keys are refreshed.
+	RefreshAhead time.Duration
+
+	// NotFoundTTL, if non-zero, is how long ErrNotFound returned from the
+	// Getter is cached for.
+	NotFoundTTL time.Duration
+
+	// LoadTimeout, if non-zero, limits how long a single load of a key from
+	// its owner or the Getter can take. Loads are shared between concurrent
+	// callers, and keep running until they complete, LoadTimeout elapses,
+	// or every caller waiting on them has gone.
+	LoadTimeout time.Duration
+
+	// Replicas is the number of peers that own each key. Keys are loaded
+	// from the first available owner, and values loaded by the primary
+	// owner are pushed to the others in the background, so that they can be
+	// served while the primary is unavailable. Defaults to 1.
+	Replicas int
+
+	// HandoffBytes, if non-zero, enables handing off entries after the
+	// peers change. Up to HandoffBytes of the entries in the local store
+	// that are now owned by other peers are sent to their new owners, if
+	// the local store is a Ranger and the peers are HandoffPeers.
+	HandoffBytes int
+	// HandoffRate, if non-zero, limits the bytes per second sent during a
+	// handoff.
+	HandoffRate int
+
+	// DrainTimeout is how long peers removed by SetPeers are given to
+	// finish in-flight requests before they're closed. Defaults to 10
+	// seconds.
+	DrainTimeout time.Duration
+
+	// CloseStores causes Close to also close the hot and local stores, if
+	// they implement io.Closer.
+	CloseStores bool
+
+	// Ejection configures when unhealthy peers are temporarily removed from
+	// routing. Disabled by default.
+	Ejection Ejection
+
+	// Hedging configures hedged requests for keys owned by slow peers.
+	// Disabled by default.
+	Hedging Hedging
 }
 
 func New(opts Options) *Cache {
 	c := &Cache{
-		me:          opts.Me,
-		hotStore:    opts.HotStore,
-		localStore:  opts.LocalStore,
-		getter:      opts.Getter,
-		peerCreator: opts.PeerCreator,
+		me:           opts.Me,
+		hotStore:     opts.HotStore,
+		localStore:   opts.LocalStore,
+		getter:       opts.Getter,
+		peerCreator:  opts.PeerCreator,
+		newPicker:    opts.Picker,
+		admission:    opts.Admission,
+		observer:     opts.Observer,
+		tracer:       opts.Tracer,
+		softTTL:      opts.SoftTTL,
+		refreshAhead: opts.RefreshAhead,
+		notFoundTTL:  opts.NotFoundTTL,
+		replicas:     opts.Replicas,
+		handoffBytes: opts.HandoffBytes,
+		handoffRate:  opts.HandoffRate,
+		drainTimeout: opts.DrainTimeout,
+		closeStores:  opts.CloseStores,
+		ejection:     opts.Ejection,
+		hedging:      opts.Hedging,
+		hedgeBudget:  newHedgeBudget(opts.Hedging.Budget),
+	}
+	if c.drainTimeout <= 0 {
+		c.drainTimeout = defaultDrainTimeout
+	}
+	if c.newPicker == nil {
+		c.newPicker = defaultPicker
+	}
+	if c.admission == nil {
+		c.admission = RandomAdmission(0.2)
+	}
+	c.single.timeout = opts.LoadTimeout
+	c.refreshing.timeout = opts.LoadTimeout
+	if opts.HardTTL > opts.SoftTTL {
+		c.staleTTL = opts.HardTTL - opts.SoftTTL
+	}
+	if opts.PeerInfos != nil {
+		c.SetPeerInfos(opts.PeerInfos...)
+	} else {
+		c.SetPeers(opts.Peers...)
 	}
-	c.SetPeers(opts.Peers...)
 	return c
 }
 
 func (c *Cache) Get(ctx context.Context, key string) ([]byte, ResultSource, error) {
-	ch := c.single.DoChan(key, func() (interface{}, error) {
+	res, err := c.GetResult(ctx, key)
+	if err != nil {
+		return nil, ResultNone, err
+	}
+	return res.Value, res.Source, nil
+}
+
+// GetResult is like Get, but also returns the remaining lifetime of the value.
+func (c *Cache) GetResult(ctx context.Context, key string) (Result, error) {
+	if c.closed.Load() {
+		return Result{}, ErrClosed
+	}
+	start := time.Now()
+	ctx, span := c.startSpan(ctx, "distcache.Get", key)
+	c.admission.Record(key)
+	ch, leader, release := c.single.DoChan(ctx, key, func(ctx context.Context) (interface{}, error) {
 		return c.get(ctx, key)
 	})
+	defer release()
 	var res singleflight.Result
 	select {
 	case <-ctx.Done():
-		return nil, ResultNone, ctx.Err()
+		res.Err = ctx.Err()
 	case res = <-ch:
 	}
-	if res.Err != nil {
-		return nil, ResultNone, res.Err
+	var result Result
+	if res.Err == nil {
+		result = res.Val.(Result)
+		span.SetAttributes(Attribute{Key: AttrResultSource, Value: result.Source.String()})
 	}
-	result := res.Val.(getResult)
-	return result.Value, result.Source, nil
+	endSpan(span, res.Err)
+	c.observeGet(ctx, key, result, !leader, start, res.Err)
+	return result, res.Err
 }
 
-type getResult struct {
-	Source ResultSource
+// Result is a value returned from the cache, along with where it came from
+// and how long it remains valid for.
+type Result struct {
 	Value  []byte
+	Source ResultSource
+	// TTL is the remaining lifetime of Value, including any time that it can
+	// be served stale, or zero if it never expires.
+	TTL time.Duration
 }
 
-func (c *Cache) get(ctx context.Context, key string) (getResult, error) {
-	if res, ok := c.getFromStores(ctx, key); ok {
-		return res, nil
+func (c *Cache) get(ctx context.Context, key string) (Result, error) {
+	if res, ok, err := c.getFromStores(ctx, key); ok {
+		if err != nil {
+			return Result{}, err
+		}
+		return c.checkFreshness(ctx, key, res), nil
 	}
+	return c.load(ctx, key)
+}
 
+// load gets the value for key from its owner, bypassing the local stores.
+func (c *Cache) load(ctx context.Context, key string) (res Result, err error) {
 	c.mu.Lock()
-	hash := c.hash
+	picker := c.picker
 	peers := c.peers
 	c.mu.Unlock()
 
-	addr := hash.GetPeer([]byte(key))
-	if addr == c.me {
-		return c.getLocal(ctx, key)
-	}
+	var addr string
+	ctx = c.deletions.startLoad(ctx)
+	ctx, span := c.startSpan(ctx, "distcache.Load", key)
+	defer func() {
+		if c.tracer != nil {
+			span.SetAttributes(
+				Attribute{Key: AttrPeer, Value: addr},
+				Attribute{Key: AttrResultSource, Value: res.Source.String()},
+			)
+		}
+		endSpan(span, err)
+	}()
+
+	res, addr, err = c.loadFrom(ctx, picker, peers, key, c.owners(picker, key), 0)
+	return res, err
+}
 
-	if peer, ok := peers[addr]; ok {
-		val, err := c.getFromPeer(ctx, peer, key)
-		if err == nil {
-			return val, nil
+// loadFrom tries each owner of key in order, starting at index i, until one of
+// them returns the value, falling back to the local Getter if none do. It
+// also returns the address of the last owner tried.
+func (c *Cache) loadFrom(ctx context.Context, picker PeerPicker, peers peerMap, key string, owners []string, i int) (Result, string, error) {
+	var addr string
+	var peerErr error
+	for ; i < len(owners); i++ {
+		addr = owners[i]
+		if addr == c.me {
+			res, err := c.getLocal(ctx, key)
+			if err == nil && i == 0 {
+				c.replicate(ctx, picker, peers, map[string]Entry{key: {Value: res.Value, TTL: res.TTL}})
+			}
+			return res, addr, err
+		}
+		peer, ok := peers.acquire(addr)
+		if !ok {
+			continue
+		}
+		if !c.allowPeer(ctx, addr, peer) {
+			peer.release()
+			peerErr = errPeerEjected
+			continue
 		}
-		// TODO(ryanfowler): What to do with error here?
+		next := i + 1
+		res, err := c.getFromPeerHedged(ctx, addr, peer, key, func(ctx context.Context) (Result, error) {
+			res, _, err := c.loadFrom(ctx, picker, peers, key, owners, next)
+			return res, err
+		})
+		peer.release()
+		if err == nil || errors.Is(err, ErrNotFound) {
+			return res, addr, err
+		}
+		peerErr = err
 	}
 
 	// Otherwise, fallback to getting locally.
-	return c.fallbackToLocal(ctx, key)
+	c.observe(ctx, FallbackEvent{Peer: addr, Keys: []string{key}, Err: peerErr})
+	res, err := c.fallbackToLocal(ctx, key)
+	return res, addr, err
 }
 
-func (c *Cache) getFromStores(ctx context.Context, key string) (getResult, bool) {
-	// TODO(ryanfowler): How to handle errors here?
-	val, err := c.hotStore.Get(ctx, key)
+// getFromStores returns the value for key from the hot or local stores, if
+// present. A cached miss is returned as ErrNotFound.
+func (c *Cache) getFromStores(ctx context.Context, key string) (Result, bool, error) {
+	// Store errors are reported to the observer, and treated as misses.
+	val, ttl, err := c.storeGet(ctx, StoreHot, key)
 	if err == nil && val != nil {
-		return getResult{Source: ResultHotCache, Value: val}, true
+		return Result{Source: ResultHotCache, Value: val, TTL: ttl}, true, nil
 	}
-	val, err = c.localStore.Get(ctx, key)
+	val, ttl, err = c.storeGet(ctx, StoreLocal, key)
 	if err == nil && val != nil {
-		return getResult{Source: ResultLocalCache, Value: val}, true
+		return Result{Source: ResultLocalCache, Value: val, TTL: ttl}, true, nil
+	}
+	if c.notFoundTTL > 0 && c.isNotFound(ctx, key) {
+		return Result{}, true, ErrNotFound
 	}
-	return getResult{}, false
+	return Result{}, false, nil
 }
 
-func (c *Cache) getFromPeer(ctx context.Context, peer Peer, key string) (getResult, error) {
-	val, src, err := peer.Get(ctx, key)
+func (c *Cache) getFromPeer(ctx context.Context, addr string, peer *peerHandle, key string) (Result, error) {
+	peerCtx, done := c.observePeer(ctx, addr, "Get", key)
+	start := time.Now()
+	res, err := peer.Get(peerCtx, key)
+	c.recordPeer(ctx, addr, peer, time.Since(start), err)
+	done(err)
 	if err != nil {
-		return getResult{}, err
+		return Result{}, err
+	}
+	return c.fromPeer(ctx, key, res), nil
+}
+
+// fromPeer populates the hot store with a result returned from a peer.
+func (c *Cache) fromPeer(ctx context.Context, key string, res Result) Result {
+	if c.isStale(res.TTL) {
+		res.Source = ResultStale
+		return res
 	}
-	c.populateHotStore(ctx, key, val)
-	return getResult{Source: src, Value: val}, nil
+	// The peer's TTL is the remaining lifetime of the owner's copy, so the
+	// hot copy can never outlive it.
+	c.populateHotStore(ctx, key, res.Value, res.TTL)
+	return res
 }
 
-func (c *Cache) getLocal(ctx context.Context, key string) (getResult, error) {
-	val, err := c.getter.Get(ctx, key)
+func (c *Cache) getLocal(ctx context.Context, key string) (Result, error) {
+	val, ttl, err := c.getterGet(ctx, key)
 	if err != nil {
-		return getResult{}, err
+		if errors.Is(err, ErrNotFound) {
+			c.cacheNotFound(ctx, StoreLocal, key)
+		}
+		return Result{}, err
 	}
-	c.populateLocalStore(ctx, key, val)
-	return getResult{Source: ResultLocalGet, Value: val}, nil
+	ttl = c.storeTTL(ttl)
+	c.populateLocalStore(ctx, key, val, ttl)
+	return Result{Source: ResultLocalGet, Value: val, TTL: ttl}, nil
 }
 
-func (c *Cache) fallbackToLocal(ctx context.Context, key string) (getResult, error) {
-	val, err := c.getter.Get(ctx, key)
+func (c *Cache) fallbackToLocal(ctx context.Context, key string) (Result, error) {
+	val, ttl, err := c.getterGet(ctx, key)
 	if err != nil {
-		return getResult{}, err
+		if errors.Is(err, ErrNotFound) {
+			c.cacheNotFound(ctx, StoreHot, key)
+		}
+		return Result{}, err
 	}
-	c.populateHotStore(ctx, key, val)
-	return getResult{Source: ResultLocalGet, Value: val}, nil
+	ttl = c.storeTTL(ttl)
+	c.populateHotStore(ctx, key, val, ttl)
+	return Result{Source: ResultLocalGet, Value: val, TTL: ttl}, nil
 }
 
-func (c *Cache) populateHotStore(ctx context.Context, key string, val []byte) {
-	// TODO(ryanfowler): How do we populate the hot cache?
-	if rand.Int31n(5) == 0 { //nolint:gosec
-		_ = c.hotStore.Set(ctx, key, val)
+func (c *Cache) getterGet(ctx context.Context, key string) ([]byte, time.Duration, error) {
+	ctx, done := c.observeGetter(ctx, key)
+	val, ttl, err := c.getter.Get(ctx, key)
+	done(err)
+	return val, ttl, err
+}
+
+func (c *Cache) populateHotStore(ctx context.Context, key string, val []byte, ttl time.Duration) {
+	if c.deletions.deletedSince(ctx, key) {
+		return
+	}
+	if c.admission.Admit(key) {
+		_ = c.storeSet(ctx, StoreHot, key, val, ttl)
 	}
 }
 
-func (c *Cache) populateLocalStore(ctx context.Context, key string, val []byte) {
-	// TODO(ryanfowler): Error handling?
-	_ = c.localStore.Set(ctx, key, val)
+func (c *Cache) populateLocalStore(ctx context.Context, key string, val []byte, ttl time.Duration) {
+	if c.deletions.deletedSince(ctx, key) {
+		return
+	}
+	// Errors are reported to the observer.
+	_ = c.storeSet(ctx, StoreLocal, key, val, ttl)
+}
+
+// Delete removes key, and any cached miss for it, from this node's hot and
+// local stores. Loads of key that are already in flight won't store their
+// values.
+func (c *Cache) Delete(ctx context.Context, key string) error {
+	// Any in-flight load may return the old value, so don't let new calls
+	// join it, or write it to the stores.
+	c.single.Forget(key)
+	c.deletions.markDeleted(key)
+
+	nfKey := notFoundKey(key)
+	return errors.Join(
+		c.storeDelete(ctx, StoreHot, key),
+		c.storeDelete(ctx, StoreLocal, key),
+		c.hotStore.Delete(ctx, nfKey),
+		c.localStore.Delete(ctx, nfKey),
+	)
 }
 
+// Invalidate removes key from this node's stores, the owning peers, and the
+// hot stores of every other peer.
+func (c *Cache) Invalidate(ctx context.Context, key string) error {
+	var errs []error
+	if err := c.Delete(ctx, key); err != nil {
+		errs = append(errs, err)
+	}
+
+	c.mu.Lock()
+	picker := c.picker
+	peers := c.peers
+	c.mu.Unlock()
+
+	// Delete from the owners first, so that other peers can't repopulate
+	// their hot stores with the old value once they've been purged.
+	owners := c.owners(picker, key)
+	for _, owner := range owners {
+		if peer, ok := peers.acquire(owner); ok {
+			if err := c.deleteFromPeer(ctx, owner, peer, key); err != nil {
+				errs = append(errs, err)
+			}
+			peer.release()
+		}
+	}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for addr := range peers {
+		if slices.Contains(owners, addr) {
+			continue
+		}
+		peer, ok := peers.acquire(addr)
+		if !ok {
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer peer.release()
+			if err := c.deleteFromPeer(ctx, addr, peer, key); err != nil {
+				mu.Lock()
+				errs = append(errs, err)
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	return errors.Join(errs...)
+}
+
+func (c *Cache) deleteFromPeer(ctx context.Context, addr string, peer Peer, key string) error {
+	ctx, done := c.observePeer(ctx, addr, "Delete", key)
+	err := peer.Delete(ctx, key)
+	done(err)
+	if err != nil {
+		return fmt.Errorf("peer %s: %w", addr, err)
+	}
+	return nil
+}
+
+// SetPeers sets the addresses of all peers in the cluster, including this
+// node, each with a weight of 1.
 func (c *Cache) SetPeers(peers ...string) {
+	c.SetPeerInfos(peerInfos(peers)...)
+}
+
+// SetPeerInfos sets all peers in the cluster, including this node, along with
+// their weights.
+func (c *Cache) SetPeerInfos(peers ...PeerInfo) {
 	c.muSetPeers.Lock()
 	defer c.muSetPeers.Unlock()
+	if c.closed.Load() {
+		return
+	}
 
 	c.mu.Lock()
 	existingPeers := c.peers
+	existingInfos := c.peerInfos
 	c.mu.Unlock()
 
-	// Create new hash and peer map.
-	newHash := newPeerHash(peers...)
-	newPeers := make(map[string]Peer, len(peers))
-	for _, addr := range peers {
+	// Create new picker and peer map.
+	newPicker := c.newPicker(peers...)
+	newPeers := make(peerMap, len(peers))
+	for _, info := range peers {
+		addr := info.Addr
 		if addr == c.me {
 			continue
 		}
@@ -190,51 +529,99 @@ func (c *Cache) SetPeers(peers ...string) {
 			newPeers[addr] = peer
 			continue
 		}
-		newPeers[addr] = c.peerCreator.NewPeer(addr)
+		newPeers[addr] = newPeerHandle(c.peerCreator.NewPeer(addr), newPeerHealth(c.ejection))
+		c.observe(context.Background(), PeerAddedEvent{Peer: addr})
 	}
 
-	// Close any peers that were removed.
+	// Close any peers that were removed, once they're no longer in use.
 	for addr, peer := range existingPeers {
 		if _, ok := newPeers[addr]; !ok {
-			// TODO(ryanfowler): How do we handle an error here?
-			// Also, it would be more ideal to do a graceful
-			// shutdown here.
-			_ = peer.Close()
+			c.drainPeer(addr, peer)
 		}
 	}
 
 	c.mu.Lock()
-	c.hash = newHash
+	c.picker = newPicker
 	c.peers = newPeers
+	c.peerInfos = append([]PeerInfo(nil), peers...)
+	c.mu.Unlock()
+
+	// Only hand off keys when the ring changes, rather than every time that
+	// the same peers are set again.
+	changed := !slices.Equal(sortedPeers(existingInfos), sortedPeers(peers))
+	if c.handoffBytes > 0 && existingPeers != nil && changed {
+		c.startHandoff(newPicker, newPeers)
+	}
+}
+
+// Owner returns the address of the peer that owns key.
+func (c *Cache) Owner(key string) string {
+	c.mu.Lock()
+	picker := c.picker
 	c.mu.Unlock()
+	return picker.PickPeer(key)
 }
 
+// Owners returns the addresses of the peers that own key, starting with its
+// primary owner, followed by its replicas.
+func (c *Cache) Owners(key string) []string {
+	c.mu.Lock()
+	picker := c.picker
+	c.mu.Unlock()
+	return c.owners(picker, key)
+}
+
+// Peers returns all peers in the cluster, including this node, as last set.
+func (c *Cache) Peers() []PeerInfo {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]PeerInfo(nil), c.peerInfos...)
+}
+
+// Getter returns the value for a key, along with how long the value remains
+// valid for. A TTL of zero means that the value never expires.
 type Getter interface {
-	Get(ctx context.Context, key string) ([]byte, error)
+	Get(ctx context.Context, key string) ([]byte, time.Duration, error)
 }
 
-type GetterFunc func(ctx context.Context, key string) ([]byte, error)
+type GetterFunc func(ctx context.Context, key string) ([]byte, time.Duration, error)
 
-func (gf GetterFunc) Get(ctx context.Context, key string) ([]byte, error) {
+func (gf GetterFunc) Get(ctx context.Context, key string) ([]byte, time.Duration, error) {
 	return gf(ctx, key)
 }
 
+// Setter stores the value for a key. A TTL of zero means that the value never
+// expires.
 type Setter interface {
-	Set(ctx context.Context, key string, val []byte) error
+	Set(ctx context.Context, key string, val []byte, ttl time.Duration) error
+}
+
+// Deleter removes the value for a key.
+type Deleter interface {
+	Delete(ctx context.Context, key string) error
 }
 
 type Peer interface {
 	io.Closer
-	Get(ctx context.Context, key string) ([]byte, ResultSource, error)
+	Get(ctx context.Context, key string) (Result, error)
+	// GetMulti returns the results for multiple keys. If only some keys
+	// fail, the error returned is a KeyErrors.
+	GetMulti(ctx context.Context, keys []string) (map[string]Result, error)
+	// Delete removes key from the peer's hot and local stores.
+	Delete(ctx context.Context, key string) error
 }
 
 type PeerCreator interface {
 	NewPeer(addr string) Peer
 }
 
+// Store is a Getter and Setter that stores values locally. Get returns a nil
+// value if the key is not present or has expired, and otherwise the remaining
+// lifetime of the value.
 type Store interface {
 	Getter
 	Setter
+	Deleter
 }
 
 type ResultSource int
@@ -246,6 +633,13 @@ const (
 	ResultLocalGet
 	ResultPeerCache
 	ResultPeerGet
+	ResultStale
+	// ResultHedgedLocalGet is returned when a hedged call to the Getter
+	// returned before the owning peer.
+	ResultHedgedLocalGet
+	// ResultHedgedPeer is returned when a hedged request to a replica
+	// returned before the owning peer.
+	ResultHedgedPeer
 )
 
 func (rs ResultSource) String() string {
@@ -262,6 +656,12 @@ func (rs ResultSource) String() string {
 		return "cache_peer"
 	case ResultPeerGet:
 		return "get_peer"
+	case ResultStale:
+		return "stale"
+	case ResultHedgedLocalGet:
+		return "hedged_get_local"
+	case ResultHedgedPeer:
+		return "hedged_peer"
 	default:
 		return "unknown"
 	}
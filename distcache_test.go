@@ -0,0 +1,2098 @@
+package distcache_test
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ryanfowler/distcache"
+	"github.com/ryanfowler/distcache/lru"
+	"github.com/ryanfowler/distcache/protocodec"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+func TestInvalidate(t *testing.T) {
+	ctx := context.Background()
+	peers := newMockPeers()
+	hotStore := lru.New(1 << 20)
+	localStore := lru.New(1 << 20)
+	cache := distcache.New(distcache.Options{
+		Me:          "me",
+		HotStore:    hotStore,
+		LocalStore:  localStore,
+		Getter:      keyGetter(),
+		PeerCreator: peers,
+		Peers:       []string{"me", "peer1", "peer2", "peer3"},
+	})
+
+	_ = hotStore.Set(ctx, "key", []byte("old"), 0)
+	_ = localStore.Set(ctx, "key", []byte("old"), 0)
+
+	if err := cache.Invalidate(ctx, "key"); err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	if val, _, _ := hotStore.Get(ctx, "key"); val != nil {
+		t.Fatalf("unexpected value in hot store: %q", val)
+	}
+	if val, _, _ := localStore.Get(ctx, "key"); val != nil {
+		t.Fatalf("unexpected value in local store: %q", val)
+	}
+
+	deleted := peers.deletedFrom("key")
+	if len(deleted) != 3 {
+		t.Fatalf("unexpected peers invalidated: %v", deleted)
+	}
+}
+
+func TestInvalidateDuringLoad(t *testing.T) {
+	ctx := context.Background()
+	for name, invalidate := range map[string]func(*distcache.Cache) error{
+		"invalidate": func(c *distcache.Cache) error { return c.Invalidate(ctx, "key") },
+		// Peers handle invalidations with Delete.
+		"delete": func(c *distcache.Cache) error { return c.Delete(ctx, "key") },
+	} {
+		for _, multi := range []bool{false, true} {
+			t.Run(fmt.Sprintf("%s/multi=%t", name, multi), func(t *testing.T) {
+				var source atomic.Value
+				source.Store("old")
+				started := make(chan struct{}, 1)
+				unblock := make(chan struct{})
+				getter := distcache.GetterFunc(func(ctx context.Context, key string) ([]byte, time.Duration, error) {
+					val := source.Load().(string)
+					select {
+					case started <- struct{}{}:
+						<-unblock
+					default:
+					}
+					return []byte(val), 0, nil
+				})
+				cache := distcache.New(distcache.Options{
+					Me:         "me",
+					HotStore:   lru.New(1 << 20),
+					LocalStore: lru.New(1 << 20),
+					Getter:     getter,
+					Peers:      []string{"me"},
+				})
+				get := func() string {
+					if multi {
+						results, err := cache.GetMulti(ctx, []string{"key"})
+						if err != nil {
+							t.Errorf("unexpected error: %s", err.Error())
+						}
+						return string(results["key"].Value)
+					}
+					val, _, err := cache.Get(ctx, "key")
+					if err != nil {
+						t.Errorf("unexpected error: %s", err.Error())
+					}
+					return string(val)
+				}
+
+				// The load reads the old value, then the source is updated and
+				// invalidated before the load completes.
+				done := make(chan string, 1)
+				go func() { done <- get() }()
+				<-started
+				source.Store("new")
+				if err := invalidate(cache); err != nil {
+					t.Fatalf("unexpected error: %s", err.Error())
+				}
+				close(unblock)
+				if val := <-done; val != "old" {
+					t.Fatalf("unexpected value from in-flight load: %q", val)
+				}
+
+				if val := get(); val != "new" {
+					t.Fatalf("unexpected value after invalidation: %q", val)
+				}
+			})
+		}
+	}
+}
+
+func TestInvalidateDuringReplicatedLoad(t *testing.T) {
+	ctx := context.Background()
+	for _, multi := range []bool{false, true} {
+		t.Run(fmt.Sprintf("multi=%t", multi), func(t *testing.T) {
+			var source atomic.Value
+			source.Store("old")
+			started := make(chan struct{}, 1)
+			unblock := make(chan struct{})
+			getter := distcache.GetterFunc(func(ctx context.Context, key string) ([]byte, time.Duration, error) {
+				val := source.Load().(string)
+				select {
+				case started <- struct{}{}:
+					<-unblock
+				default:
+				}
+				return []byte(val), 0, nil
+			})
+			var replicated atomic.Int64
+			observer := distcache.ObserverFunc(func(ctx context.Context, event distcache.Event) {
+				if e, ok := event.(distcache.PeerRequestEvent); ok && e.Method == "Replicate" {
+					replicated.Add(1)
+				}
+			})
+			cluster := newMemCluster()
+			localStores := make(map[string]*lru.LRU)
+			for _, addr := range []string{"a", "b"} {
+				localStores[addr] = lru.New(1 << 20)
+				cluster.add(addr, distcache.New(distcache.Options{
+					Me:          addr,
+					HotStore:    lru.New(1 << 20),
+					LocalStore:  localStores[addr],
+					Getter:      getter,
+					PeerCreator: cluster,
+					Peers:       []string{"a", "b"},
+					Admission:   distcache.RandomAdmission(0),
+					Replicas:    2,
+					Observer:    observer,
+				}))
+			}
+			a := cluster.cache("a")
+			key := ownedBy(a, "a", 0)
+			get := func() string {
+				if multi {
+					results, err := a.GetMulti(ctx, []string{key})
+					if err != nil {
+						t.Errorf("unexpected error: %s", err.Error())
+					}
+					return string(results[key].Value)
+				}
+				val, _, err := a.Get(ctx, key)
+				if err != nil {
+					t.Errorf("unexpected error: %s", err.Error())
+				}
+				return string(val)
+			}
+
+			// The old value loaded before the invalidation isn't pushed to
+			// the replica, only the new value loaded after it.
+			done := make(chan string, 1)
+			go func() { done <- get() }()
+			<-started
+			source.Store("new")
+			if err := a.Invalidate(ctx, key); err != nil {
+				t.Fatalf("unexpected error: %s", err.Error())
+			}
+			close(unblock)
+			<-done
+			if val := get(); val != "new" {
+				t.Fatalf("unexpected value after invalidation: %q", val)
+			}
+			if err := retry(func() bool { return replicated.Load() > 0 }); err != nil {
+				t.Fatal("value not replicated")
+			}
+			time.Sleep(20 * time.Millisecond)
+			if n := replicated.Load(); n != 1 {
+				t.Fatalf("unexpected number of replications: %d", n)
+			}
+			if val, _, _ := localStores["b"].Get(ctx, key); string(val) != "new" {
+				t.Fatalf("unexpected value in replica: %q", val)
+			}
+		})
+	}
+}
+
+func TestTTL(t *testing.T) {
+	ctx := context.Background()
+	clock := &testClock{now: time.Now()}
+	cluster := newMemCluster()
+	hotStores := make(map[string]*clockStore)
+	localStores := make(map[string]*clockStore)
+	var calls atomic.Int64
+	for _, addr := range []string{"a", "b"} {
+		hotStores[addr] = newClockStore(clock)
+		localStores[addr] = newClockStore(clock)
+		cluster.add(addr, distcache.New(distcache.Options{
+			Me:         addr,
+			HotStore:   hotStores[addr],
+			LocalStore: localStores[addr],
+			Getter: distcache.GetterFunc(func(ctx context.Context, key string) ([]byte, time.Duration, error) {
+				calls.Add(1)
+				return []byte(key), time.Minute, nil
+			}),
+			PeerCreator: cluster,
+			Peers:       []string{"a", "b"},
+			Admission:   distcache.AlwaysAdmit(),
+		}))
+	}
+	a := cluster.cache("a")
+	key := ownedBy(a, "b", 0)
+
+	get := func(src distcache.ResultSource, ttl time.Duration) {
+		t.Helper()
+		res, err := a.GetResult(ctx, key)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err.Error())
+		}
+		if string(res.Value) != key || res.Source != src || res.TTL != ttl {
+			t.Fatalf("unexpected result: %q, %s, %s", res.Value, res.Source, res.TTL)
+		}
+	}
+	checkStore := func(name string, store *clockStore, ttl time.Duration) {
+		t.Helper()
+		val, got, _ := store.Get(ctx, key)
+		if ttl == 0 && val != nil {
+			t.Fatalf("unexpected value in %s after it expired", name)
+		}
+		if ttl != 0 && (val == nil || got != ttl) {
+			t.Fatalf("unexpected ttl in %s: %q, %s", name, val, got)
+		}
+	}
+
+	// The owner stores the Getter's TTL, and passes it to the peer that
+	// requested the key.
+	get(distcache.ResultPeerGet, time.Minute)
+	checkStore("owner's local store", localStores["b"], time.Minute)
+	checkStore("hot store", hotStores["a"], time.Minute)
+
+	// A peer's hot copy expires with the owner's copy, even when it was
+	// fetched later.
+	clock.advance(20 * time.Second)
+	get(distcache.ResultHotCache, 40*time.Second)
+	_ = hotStores["a"].Delete(ctx, key)
+	get(distcache.ResultPeerCache, 40*time.Second)
+	checkStore("hot store", hotStores["a"], 40*time.Second)
+
+	clock.advance(40 * time.Second)
+	checkStore("hot store", hotStores["a"], 0)
+	checkStore("owner's local store", localStores["b"], 0)
+	get(distcache.ResultPeerGet, time.Minute)
+	if n := calls.Load(); n != 2 {
+		t.Fatalf("unexpected number of getter calls: %d", n)
+	}
+}
+
+// testClock is a clock that only moves when advanced.
+type testClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *testClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *testClock) advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+// clockStore is a Store that expires values using a testClock.
+type clockStore struct {
+	clock   *testClock
+	mu      sync.Mutex
+	values  map[string][]byte
+	expires map[string]time.Time
+}
+
+func newClockStore(clock *testClock) *clockStore {
+	return &clockStore{
+		clock:   clock,
+		values:  make(map[string][]byte),
+		expires: make(map[string]time.Time),
+	}
+}
+
+func (s *clockStore) Get(ctx context.Context, key string) ([]byte, time.Duration, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	val, ok := s.values[key]
+	if !ok {
+		return nil, 0, nil
+	}
+	expires, ok := s.expires[key]
+	if !ok {
+		return val, 0, nil
+	}
+	ttl := expires.Sub(s.clock.Now())
+	if ttl <= 0 {
+		return nil, 0, nil
+	}
+	return val, ttl, nil
+}
+
+func (s *clockStore) Set(ctx context.Context, key string, val []byte, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.values[key] = val
+	delete(s.expires, key)
+	if ttl > 0 {
+		s.expires[key] = s.clock.Now().Add(ttl)
+	}
+	return nil
+}
+
+func (s *clockStore) Delete(ctx context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.values, key)
+	delete(s.expires, key)
+	return nil
+}
+
+func TestGetMulti(t *testing.T) {
+	ctx := context.Background()
+	peers := newMockPeers()
+	localStore := lru.New(1 << 20)
+	getter := &batchGetter{}
+	cache := distcache.New(distcache.Options{
+		Me:          "me",
+		HotStore:    lru.New(1 << 20),
+		LocalStore:  localStore,
+		Getter:      getter,
+		PeerCreator: peers,
+		Peers:       []string{"me", "peer1", "peer2"},
+	})
+
+	_ = localStore.Set(ctx, "cached", []byte("cached"), 0)
+
+	keys := []string{"cached", "cached"}
+	for i := 0; i < 100; i++ {
+		keys = append(keys, strconv.Itoa(i))
+	}
+	results, err := cache.GetMulti(ctx, keys)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	if len(results) != 101 {
+		t.Fatalf("unexpected number of results: %d", len(results))
+	}
+	if res := results["cached"]; res.Source != distcache.ResultLocalCache {
+		t.Fatalf("unexpected result source: %s", res.Source)
+	}
+	for _, key := range keys[2:] {
+		res := results[key]
+		if string(res.Value) != key {
+			t.Fatalf("unexpected value for key %q: %q", key, res.Value)
+		}
+		if res.Source != distcache.ResultLocalGet && res.Source != distcache.ResultPeerGet {
+			t.Fatalf("unexpected result source for key %q: %s", key, res.Source)
+		}
+	}
+
+	peers.mu.Lock()
+	defer peers.mu.Unlock()
+	for addr, n := range peers.multiGets {
+		if n != 1 {
+			t.Fatalf("unexpected number of requests to peer %s: %d", addr, n)
+		}
+	}
+	if n := getter.calls.Load(); n != 1 {
+		t.Fatalf("unexpected number of getter calls: %d", n)
+	}
+}
+
+type batchGetter struct {
+	calls atomic.Int32
+}
+
+func (g *batchGetter) Get(ctx context.Context, key string) ([]byte, time.Duration, error) {
+	g.calls.Add(1)
+	return []byte(key), 0, nil
+}
+
+func (g *batchGetter) GetMulti(ctx context.Context, keys []string) (map[string]distcache.Entry, error) {
+	g.calls.Add(1)
+	entries := make(map[string]distcache.Entry, len(keys))
+	for _, key := range keys {
+		entries[key] = distcache.Entry{Value: []byte(key)}
+	}
+	return entries, nil
+}
+
+func TestStaleWhileRevalidate(t *testing.T) {
+	ctx := context.Background()
+	localStore := lru.New(1 << 20)
+	var calls atomic.Int32
+	cache := distcache.New(distcache.Options{
+		Me:         "me",
+		HotStore:   lru.New(1 << 20),
+		LocalStore: localStore,
+		Getter: distcache.GetterFunc(func(ctx context.Context, key string) ([]byte, time.Duration, error) {
+			calls.Add(1)
+			return []byte("new"), 0, nil
+		}),
+		PeerCreator: newMockPeers(),
+		Peers:       []string{"me"},
+		SoftTTL:     time.Hour,
+		HardTTL:     2 * time.Hour,
+	})
+
+	// A value with less than HardTTL-SoftTTL remaining is stale.
+	_ = localStore.Set(ctx, "key", []byte("old"), 30*time.Minute)
+
+	val, src, err := cache.Get(ctx, "key")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	if string(val) != "old" || src != distcache.ResultStale {
+		t.Fatalf("unexpected result: %q, %s", val, src)
+	}
+
+	err = retry(func() bool {
+		val, ttl, _ := localStore.Get(ctx, "key")
+		return string(val) == "new" && ttl > time.Hour
+	})
+	if err != nil {
+		t.Fatal("value was not refreshed")
+	}
+	if n := calls.Load(); n != 1 {
+		t.Fatalf("unexpected number of getter calls: %d", n)
+	}
+
+	val, src, _ = cache.Get(ctx, "key")
+	if string(val) != "new" || src != distcache.ResultLocalCache {
+		t.Fatalf("unexpected result: %q, %s", val, src)
+	}
+}
+
+func TestRefreshAhead(t *testing.T) {
+	ctx := context.Background()
+	localStore := lru.New(1 << 20)
+	cache := distcache.New(distcache.Options{
+		Me:         "me",
+		HotStore:   lru.New(1 << 20),
+		LocalStore: localStore,
+		Getter: distcache.GetterFunc(func(ctx context.Context, key string) ([]byte, time.Duration, error) {
+			return []byte("new"), time.Hour, nil
+		}),
+		PeerCreator:  newMockPeers(),
+		Peers:        []string{"me"},
+		RefreshAhead: time.Minute,
+	})
+
+	_ = localStore.Set(ctx, "key", []byte("old"), 30*time.Second)
+
+	val, src, _ := cache.Get(ctx, "key")
+	if string(val) != "old" || src != distcache.ResultLocalCache {
+		t.Fatalf("unexpected result: %q, %s", val, src)
+	}
+	err := retry(func() bool {
+		val, _, _ := localStore.Get(ctx, "key")
+		return string(val) == "new"
+	})
+	if err != nil {
+		t.Fatal("value was not refreshed")
+	}
+}
+
+func TestNotFound(t *testing.T) {
+	ctx := context.Background()
+	var calls atomic.Int32
+	cache := distcache.New(distcache.Options{
+		Me:         "me",
+		HotStore:   lru.New(1 << 20),
+		LocalStore: lru.New(1 << 20),
+		Getter: distcache.GetterFunc(func(ctx context.Context, key string) ([]byte, time.Duration, error) {
+			calls.Add(1)
+			return nil, 0, distcache.ErrNotFound
+		}),
+		PeerCreator: newMockPeers(),
+		Peers:       []string{"me"},
+		NotFoundTTL: time.Minute,
+	})
+
+	for i := 0; i < 3; i++ {
+		_, _, err := cache.Get(ctx, "key")
+		if !errors.Is(err, distcache.ErrNotFound) {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	if n := calls.Load(); n != 1 {
+		t.Fatalf("unexpected number of getter calls: %d", n)
+	}
+
+	_ = cache.Delete(ctx, "key")
+	_, _, _ = cache.Get(ctx, "key")
+	if n := calls.Load(); n != 2 {
+		t.Fatalf("unexpected number of getter calls: %d", n)
+	}
+}
+
+func TestFrequencyThresholdAdmission(t *testing.T) {
+	policy := distcache.FrequencyThreshold(1000, 3)
+	for i := 0; i < 2; i++ {
+		policy.Record("hot")
+	}
+	if policy.Admit("hot") {
+		t.Fatal("unexpected admission before reaching min count")
+	}
+	policy.Record("hot")
+	if !policy.Admit("hot") {
+		t.Fatal("expected admission after reaching min count")
+	}
+	if policy.Admit("cold") {
+		t.Fatal("unexpected admission of cold key")
+	}
+
+	// Frequencies saturate, so a higher threshold admits saturated keys.
+	policy = distcache.FrequencyThreshold(1000, 100)
+	for i := 0; i < 100; i++ {
+		policy.Record("hot")
+	}
+	if !policy.Admit("hot") {
+		t.Fatal("expected admission with a threshold above the maximum count")
+	}
+}
+
+func TestObserver(t *testing.T) {
+	ctx := context.Background()
+	var mu sync.Mutex
+	var events []distcache.Event
+	observer := distcache.ObserverFunc(func(ctx context.Context, event distcache.Event) {
+		mu.Lock()
+		events = append(events, event)
+		mu.Unlock()
+	})
+	getErr := errors.New("failed")
+	cache := distcache.New(distcache.Options{
+		Me:         "me",
+		HotStore:   lru.New(1 << 20),
+		LocalStore: lru.New(1 << 20),
+		Getter: distcache.GetterFunc(func(ctx context.Context, key string) ([]byte, time.Duration, error) {
+			return nil, 0, getErr
+		}),
+		PeerCreator: newMockPeers(),
+		Peers:       []string{"me", "peer"},
+		Observer:    observer,
+	})
+	cache.SetPeers("me")
+
+	_, _, _ = cache.Get(ctx, "key")
+
+	// Removed peers are closed in the background.
+	err := retry(func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		for _, event := range events {
+			if _, ok := event.(distcache.PeerRemovedEvent); ok {
+				return true
+			}
+		}
+		return false
+	})
+	if err != nil {
+		t.Fatal("peer not removed")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	var added, removed, storeMisses, getterErrs int
+	for _, event := range events {
+		switch event := event.(type) {
+		case distcache.PeerAddedEvent:
+			added++
+		case distcache.PeerRemovedEvent:
+			removed++
+		case distcache.StoreEvent:
+			if event.Op == distcache.StoreOpGet && !event.Hit {
+				storeMisses++
+			}
+		case distcache.GetterEvent:
+			if errors.Is(event.Err, getErr) {
+				getterErrs++
+			}
+		}
+	}
+	if added != 1 || removed != 1 {
+		t.Fatalf("unexpected peer events: %d added, %d removed", added, removed)
+	}
+	if storeMisses != 2 {
+		t.Fatalf("unexpected number of store misses: %d", storeMisses)
+	}
+	if getterErrs != 1 {
+		t.Fatalf("unexpected number of getter errors: %d", getterErrs)
+	}
+}
+
+func TestTracing(t *testing.T) {
+	ctx := context.Background()
+	tracer := &memTracer{}
+	cache := distcache.New(distcache.Options{
+		Me:          "me",
+		HotStore:    lru.New(1 << 20),
+		LocalStore:  lru.New(1 << 20),
+		Getter:      keyGetter(),
+		PeerCreator: newMockPeers(),
+		Peers:       []string{"me"},
+		Tracer:      tracer,
+	})
+
+	if _, _, err := cache.Get(ctx, "key"); err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+
+	tracer.mu.Lock()
+	defer tracer.mu.Unlock()
+	var names []string
+	for _, span := range tracer.spans {
+		names = append(names, span.name)
+		if span.attrs[distcache.AttrKeyHash] != distcache.KeyHash("key") {
+			t.Fatalf("unexpected key hash for span %s: %v", span.name, span.attrs)
+		}
+		if span.name != "distcache.Get" && span.parent == nil {
+			t.Fatalf("unexpected root span: %s", span.name)
+		}
+		if !span.ended {
+			t.Fatalf("span not ended: %s", span.name)
+		}
+	}
+	exp := []string{"distcache.Get", "distcache.Store.Get", "distcache.Store.Get", "distcache.Load", "distcache.Getter.Get"}
+	if strings.Join(names, ",") != strings.Join(exp, ",") {
+		t.Fatalf("unexpected spans: %v", names)
+	}
+	load := tracer.spans[3]
+	if load.attrs[distcache.AttrPeer] != "me" || load.attrs[distcache.AttrResultSource] != "get_local" {
+		t.Fatalf("unexpected load attributes: %v", load.attrs)
+	}
+	if getter := tracer.spans[4]; getter.parent != load {
+		t.Fatal("getter span is not a child of the load span")
+	}
+}
+
+func TestLoadDetachedFromCaller(t *testing.T) {
+	started := make(chan struct{})
+	unblock := make(chan struct{})
+	var loadErr atomic.Value
+	cache := distcache.New(distcache.Options{
+		Me:         "me",
+		HotStore:   lru.New(1 << 20),
+		LocalStore: lru.New(1 << 20),
+		Getter: distcache.GetterFunc(func(ctx context.Context, key string) ([]byte, time.Duration, error) {
+			close(started)
+			select {
+			case <-unblock:
+				return []byte(key), 0, nil
+			case <-ctx.Done():
+				loadErr.Store(ctx.Err())
+				return nil, 0, ctx.Err()
+			}
+		}),
+		Peers: []string{"me"},
+	})
+
+	// The first caller gives up before the load completes, while the second
+	// caller waits for it.
+	shortCtx, cancel := context.WithCancel(context.Background())
+	shortErr := make(chan error, 1)
+	go func() {
+		_, _, err := cache.Get(shortCtx, "key")
+		shortErr <- err
+	}()
+	<-started
+	longVal := make(chan []byte, 1)
+	go func() {
+		val, _, _ := cache.Get(context.Background(), "key")
+		longVal <- val
+	}()
+	// Wait for the second caller to join the load.
+	time.Sleep(10 * time.Millisecond)
+
+	cancel()
+	if err := <-shortErr; !errors.Is(err, context.Canceled) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	close(unblock)
+	if val := <-longVal; string(val) != "key" {
+		t.Fatalf("unexpected value: %q", val)
+	}
+	if err := loadErr.Load(); err != nil {
+		t.Fatalf("unexpected load error: %v", err)
+	}
+}
+
+func TestLoadCancelledWithoutWaiters(t *testing.T) {
+	loadErr := make(chan error, 1)
+	var loads atomic.Int32
+	cache := distcache.New(distcache.Options{
+		Me:         "me",
+		HotStore:   lru.New(1 << 20),
+		LocalStore: lru.New(1 << 20),
+		Getter: distcache.GetterFunc(func(ctx context.Context, key string) ([]byte, time.Duration, error) {
+			if loads.Add(1) > 1 {
+				return []byte(key), 0, nil
+			}
+			<-ctx.Done()
+			loadErr <- ctx.Err()
+			return nil, 0, ctx.Err()
+		}),
+		Peers: []string{"me"},
+	})
+
+	var wg sync.WaitGroup
+	for _, timeout := range []time.Duration{10 * time.Millisecond, 20 * time.Millisecond} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), timeout)
+			defer cancel()
+			if _, _, err := cache.Get(ctx, "key"); !errors.Is(err, context.DeadlineExceeded) {
+				t.Errorf("unexpected error: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	select {
+	case err := <-loadErr:
+		if !errors.Is(err, context.Canceled) {
+			t.Fatalf("unexpected load error: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("load not cancelled after all callers left")
+	}
+
+	// The abandoned load must not be joined by new callers.
+	val, _, err := cache.Get(context.Background(), "key")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	if string(val) != "key" {
+		t.Fatalf("unexpected value: %q", val)
+	}
+}
+
+func TestLoadTimeout(t *testing.T) {
+	cache := distcache.New(distcache.Options{
+		Me:          "me",
+		HotStore:    lru.New(1 << 20),
+		LocalStore:  lru.New(1 << 20),
+		LoadTimeout: 10 * time.Millisecond,
+		Getter: distcache.GetterFunc(func(ctx context.Context, key string) ([]byte, time.Duration, error) {
+			<-ctx.Done()
+			return nil, 0, ctx.Err()
+		}),
+		Peers: []string{"me"},
+	})
+
+	_, _, err := cache.Get(context.Background(), "key")
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestGetMultiDetachedFromCaller(t *testing.T) {
+	started := make(chan struct{})
+	unblock := make(chan struct{})
+	var once sync.Once
+	cache := distcache.New(distcache.Options{
+		Me:         "me",
+		HotStore:   lru.New(1 << 20),
+		LocalStore: lru.New(1 << 20),
+		Getter: distcache.GetterFunc(func(ctx context.Context, key string) ([]byte, time.Duration, error) {
+			once.Do(func() { close(started) })
+			select {
+			case <-unblock:
+				return []byte(key), 0, nil
+			case <-ctx.Done():
+				return nil, 0, ctx.Err()
+			}
+		}),
+		Peers: []string{"me"},
+	})
+
+	shortCtx, cancel := context.WithCancel(context.Background())
+	shortErr := make(chan error, 1)
+	go func() {
+		_, err := cache.GetMulti(shortCtx, []string{"a", "b"})
+		shortErr <- err
+	}()
+	<-started
+	longVal := make(chan []byte, 1)
+	go func() {
+		val, _, _ := cache.Get(context.Background(), "a")
+		longVal <- val
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	cancel()
+	if err := <-shortErr; !errors.Is(err, context.Canceled) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	close(unblock)
+	if val := <-longVal; string(val) != "a" {
+		t.Fatalf("unexpected value: %q", val)
+	}
+}
+
+func TestHandoff(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		budget int
+	}{
+		{"all", 1 << 20},
+		{"budget", 600},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			ctx := context.Background()
+			peers := newMockPeers()
+			localStore := lru.New(1 << 20)
+			cache := distcache.New(distcache.Options{
+				Me:           "me",
+				HotStore:     lru.New(1 << 20),
+				LocalStore:   localStore,
+				Getter:       keyGetter(),
+				PeerCreator:  peers,
+				Peers:        []string{"me"},
+				HandoffBytes: test.budget,
+			})
+
+			for i := 0; i < 100; i++ {
+				key := strconv.Itoa(i)
+				_ = localStore.Set(ctx, key, []byte(key), time.Hour)
+				_ = localStore.Set(ctx, "\x00distcache:notfound:"+key, []byte{}, time.Hour)
+			}
+			cache.SetPeers("me", "peer1")
+
+			var want int
+			for i := 0; i < 100; i++ {
+				if cache.Owner(strconv.Itoa(i)) == "peer1" {
+					want++
+				}
+			}
+			var handoffs map[string]distcache.Entry
+			err := retry(func() bool {
+				peers.mu.Lock()
+				defer peers.mu.Unlock()
+				handoffs = peers.handoffs["peer1"]
+				return len(handoffs) > 0
+			})
+			if err != nil {
+				t.Fatal("no entries handed off")
+			}
+
+			peers.mu.Lock()
+			defer peers.mu.Unlock()
+			var size int
+			for key, entry := range handoffs {
+				if cache.Owner(key) != "peer1" || strings.HasPrefix(key, "\x00") {
+					t.Fatalf("unexpected key handed off: %q", key)
+				}
+				if string(entry.Value) != key || entry.TTL <= 0 || entry.TTL > time.Hour {
+					t.Fatalf("unexpected entry for key %q: %+v", key, entry)
+				}
+				size += len(key) + len(entry.Value)
+			}
+			if size > test.budget {
+				t.Fatalf("handoff of %d bytes exceeds budget", size)
+			}
+			if test.budget > 1000 && len(handoffs) != want {
+				t.Fatalf("unexpected number of keys handed off: %d, want %d", len(handoffs), want)
+			}
+		})
+	}
+}
+
+func TestHandoffReplicas(t *testing.T) {
+	ctx := context.Background()
+	peers := newMockPeers()
+	localStore := lru.New(1 << 20)
+	var handoffs atomic.Int64
+	cache := distcache.New(distcache.Options{
+		Me:           "me",
+		HotStore:     lru.New(1 << 20),
+		LocalStore:   localStore,
+		Getter:       keyGetter(),
+		PeerCreator:  peers,
+		Peers:        []string{"me"},
+		Replicas:     2,
+		HandoffBytes: 1 << 20,
+		Observer: distcache.ObserverFunc(func(ctx context.Context, event distcache.Event) {
+			if _, ok := event.(distcache.HandoffEvent); ok {
+				handoffs.Add(1)
+			}
+		}),
+	})
+	for i := 0; i < 100; i++ {
+		key := strconv.Itoa(i)
+		_ = localStore.Set(ctx, key, []byte(key), time.Hour)
+	}
+
+	// Only keys that this node no longer owns, or holds a replica of, are
+	// handed off to their primary owner.
+	cache.SetPeers("me", "peer1", "peer2")
+	var want int
+	for i := 0; i < 100; i++ {
+		if !slices.Contains(cache.Owners(strconv.Itoa(i)), "me") {
+			want++
+		}
+	}
+	handedOff := func() int {
+		peers.mu.Lock()
+		defer peers.mu.Unlock()
+		var n int
+		for addr, entries := range peers.handoffs {
+			for key := range entries {
+				owners := cache.Owners(key)
+				if slices.Contains(owners, "me") || owners[0] != addr {
+					t.Errorf("unexpected key handed off to %s: %q", addr, key)
+				}
+				n++
+			}
+		}
+		return n
+	}
+	if err := retry(func() bool { return handedOff() == want }); err != nil {
+		t.Fatalf("unexpected number of keys handed off: %d, want %d", handedOff(), want)
+	}
+
+	// Setting the same peers again doesn't start another handoff.
+	n := handoffs.Load()
+	cache.SetPeers("peer2", "me", "peer1")
+	time.Sleep(20 * time.Millisecond)
+	if handoffs.Load() != n {
+		t.Fatal("unexpected handoff without a ring change")
+	}
+}
+
+func TestReceiveHandoff(t *testing.T) {
+	ctx := context.Background()
+	localStore := lru.New(1 << 20)
+	cache := distcache.New(distcache.Options{
+		Me:          "me",
+		HotStore:    lru.New(1 << 20),
+		LocalStore:  localStore,
+		Getter:      keyGetter(),
+		PeerCreator: newMockPeers(),
+		Peers:       []string{"me", "peer1"},
+	})
+
+	entries := make(map[string]distcache.Entry)
+	for i := 0; i < 100; i++ {
+		key := strconv.Itoa(i)
+		entries[key] = distcache.Entry{Value: []byte("handoff"), TTL: time.Hour}
+	}
+	var existing string
+	for key := range entries {
+		if cache.Owner(key) == "me" {
+			existing = key
+			_ = localStore.Set(ctx, key, []byte("existing"), 0)
+			break
+		}
+	}
+	if err := cache.Handoff(ctx, entries); err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+
+	for key := range entries {
+		val, _, _ := localStore.Get(ctx, key)
+		switch {
+		case key == existing:
+			if string(val) != "existing" {
+				t.Fatalf("existing value overwritten: %q", val)
+			}
+		case cache.Owner(key) == "me":
+			if string(val) != "handoff" {
+				t.Fatalf("unexpected value for key %q: %q", key, val)
+			}
+		default:
+			if val != nil {
+				t.Fatalf("unexpected value for key owned by peer: %q", key)
+			}
+		}
+	}
+}
+
+func TestReplicas(t *testing.T) {
+	ctx := context.Background()
+	addrs := []string{"a", "b", "c"}
+	cluster := newMemCluster()
+	var getterCalls atomic.Int64
+	localStores := make(map[string]*lru.LRU)
+	for _, addr := range addrs {
+		localStores[addr] = lru.New(1 << 20)
+		cluster.add(addr, distcache.New(distcache.Options{
+			Me:         addr,
+			HotStore:   lru.New(1 << 20),
+			LocalStore: localStores[addr],
+			Getter: distcache.GetterFunc(func(ctx context.Context, key string) ([]byte, time.Duration, error) {
+				getterCalls.Add(1)
+				return []byte(key), 0, nil
+			}),
+			PeerCreator: cluster,
+			Peers:       addrs,
+			Admission:   distcache.RandomAdmission(0),
+			Replicas:    2,
+		}))
+	}
+
+	keys := make([]string, 100)
+	for i := range keys {
+		keys[i] = strconv.Itoa(i)
+	}
+	for _, addr := range addrs {
+		if _, err := cluster.cache(addr).GetMulti(ctx, keys); err != nil {
+			t.Fatalf("unexpected error: %s", err.Error())
+		}
+	}
+	if n := getterCalls.Load(); n != int64(len(keys)) {
+		t.Fatalf("unexpected number of getter calls: %d", n)
+	}
+
+	// Wait for every value to be pushed to its replica.
+	err := retry(func() bool {
+		for _, key := range keys {
+			owners := cluster.cache("a").Owners(key)
+			for _, owner := range owners {
+				if val, _, _ := localStores[owner].Get(ctx, key); val == nil {
+					return false
+				}
+			}
+		}
+		return true
+	})
+	if err != nil {
+		t.Fatal("values not replicated")
+	}
+
+	// Take each node down in turn, as in a rolling deploy. Every key must be
+	// served by its other owner, without calling the getter.
+	for _, down := range addrs {
+		cluster.setDown(down, true)
+		for _, addr := range addrs {
+			if addr == down {
+				continue
+			}
+			for _, key := range keys {
+				val, _, err := cluster.cache(addr).Get(ctx, key)
+				if err != nil {
+					t.Fatalf("unexpected error: %s", err.Error())
+				}
+				if string(val) != key {
+					t.Fatalf("unexpected value: %q", val)
+				}
+			}
+		}
+		cluster.setDown(down, false)
+	}
+	if n := getterCalls.Load(); n != int64(len(keys)) {
+		t.Fatalf("unexpected number of getter calls after rolling deploy: %d", n)
+	}
+}
+
+// memCluster connects caches in the same process, so that they can act as
+// each other's peers.
+type memCluster struct {
+	mu     sync.Mutex
+	caches map[string]*distcache.Cache
+	down   map[string]bool
+}
+
+func newMemCluster() *memCluster {
+	return &memCluster{
+		caches: make(map[string]*distcache.Cache),
+		down:   make(map[string]bool),
+	}
+}
+
+func (m *memCluster) add(addr string, cache *distcache.Cache) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.caches[addr] = cache
+}
+
+func (m *memCluster) cache(addr string) *distcache.Cache {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.caches[addr]
+}
+
+func (m *memCluster) setDown(addr string, down bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.down[addr] = down
+}
+
+// target returns the cache at addr, or an error if it's down.
+func (m *memCluster) target(addr string) (*distcache.Cache, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.down[addr] || m.caches[addr] == nil {
+		return nil, errors.New("peer unavailable: " + addr)
+	}
+	return m.caches[addr], nil
+}
+
+func (m *memCluster) NewPeer(addr string) distcache.Peer {
+	return &memPeer{addr: addr, cluster: m}
+}
+
+type memPeer struct {
+	addr    string
+	cluster *memCluster
+}
+
+func (p *memPeer) Get(ctx context.Context, key string) (distcache.Result, error) {
+	cache, err := p.cluster.target(p.addr)
+	if err != nil {
+		return distcache.Result{}, err
+	}
+	res, err := cache.GetResult(ctx, key)
+	return toPeerResult(res), err
+}
+
+func (p *memPeer) GetMulti(ctx context.Context, keys []string) (map[string]distcache.Result, error) {
+	cache, err := p.cluster.target(p.addr)
+	if err != nil {
+		return nil, err
+	}
+	results, err := cache.GetMulti(ctx, keys)
+	for key, res := range results {
+		results[key] = toPeerResult(res)
+	}
+	return results, err
+}
+
+func (p *memPeer) Delete(ctx context.Context, key string) error {
+	cache, err := p.cluster.target(p.addr)
+	if err != nil {
+		return err
+	}
+	return cache.Delete(ctx, key)
+}
+
+func (p *memPeer) Replicate(ctx context.Context, entries map[string]distcache.Entry) error {
+	cache, err := p.cluster.target(p.addr)
+	if err != nil {
+		return err
+	}
+	return cache.Replicate(ctx, entries)
+}
+
+func (p *memPeer) Close() error {
+	return nil
+}
+
+func toPeerResult(res distcache.Result) distcache.Result {
+	switch res.Source {
+	case distcache.ResultLocalGet, distcache.ResultPeerGet:
+		res.Source = distcache.ResultPeerGet
+	default:
+		res.Source = distcache.ResultPeerCache
+	}
+	return res
+}
+
+func TestRemovePeerMidRequest(t *testing.T) {
+	for _, test := range []struct {
+		name         string
+		drainTimeout time.Duration
+	}{
+		{"drained", time.Minute},
+		{"timeout", 10 * time.Millisecond},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			ctx := context.Background()
+			peer := &blockingPeer{started: make(chan struct{}), unblock: make(chan struct{})}
+			cache := distcache.New(distcache.Options{
+				Me:         "me",
+				HotStore:   lru.New(1 << 20),
+				LocalStore: lru.New(1 << 20),
+				Getter:     keyGetter(),
+				PeerCreator: peerCreatorFunc(func(addr string) distcache.Peer {
+					return peer
+				}),
+				Peers:        []string{"me", "peer"},
+				DrainTimeout: test.drainTimeout,
+			})
+			key, other := ownedBy(cache, "peer", 0), ownedBy(cache, "peer", 1)
+
+			type result struct {
+				val []byte
+				err error
+			}
+			done := make(chan result, 1)
+			go func() {
+				val, _, err := cache.Get(ctx, key)
+				done <- result{val, err}
+			}()
+			<-peer.started
+
+			cache.SetPeers("me")
+			// New requests must not be sent to the removed peer.
+			if val, src, err := cache.Get(ctx, other); err != nil || src != distcache.ResultLocalGet {
+				t.Fatalf("unexpected result: %q, %s, %v", val, src, err)
+			}
+
+			if test.drainTimeout > time.Second {
+				time.Sleep(10 * time.Millisecond)
+				if peer.closed.Load() {
+					t.Fatal("peer closed with a request in flight")
+				}
+				close(peer.unblock)
+				res := <-done
+				if res.err != nil || string(res.val) != "peer" {
+					t.Fatalf("unexpected result: %q, %v", res.val, res.err)
+				}
+			}
+			if err := retry(peer.closed.Load); err != nil {
+				t.Fatal("peer not closed")
+			}
+			if test.drainTimeout < time.Second {
+				close(peer.unblock)
+				<-done
+			}
+		})
+	}
+}
+
+type peerCreatorFunc func(addr string) distcache.Peer
+
+func (fn peerCreatorFunc) NewPeer(addr string) distcache.Peer {
+	return fn(addr)
+}
+
+// ownedBy returns the nth key owned by addr.
+func ownedBy(cache *distcache.Cache, addr string, n int) string {
+	for i := 0; ; i++ {
+		if key := strconv.Itoa(i); cache.Owner(key) == addr {
+			if n == 0 {
+				return key
+			}
+			n--
+		}
+	}
+}
+
+// blockingPeer blocks Get calls until unblock is closed.
+type blockingPeer struct {
+	once    sync.Once
+	started chan struct{}
+	unblock chan struct{}
+	closed  atomic.Bool
+}
+
+func (p *blockingPeer) Get(ctx context.Context, key string) (distcache.Result, error) {
+	p.once.Do(func() { close(p.started) })
+	<-p.unblock
+	if p.closed.Load() {
+		return distcache.Result{}, errors.New("peer closed")
+	}
+	return distcache.Result{Value: []byte("peer"), Source: distcache.ResultPeerGet}, nil
+}
+
+func (p *blockingPeer) GetMulti(ctx context.Context, keys []string) (map[string]distcache.Result, error) {
+	return nil, errors.New("not implemented")
+}
+
+func (p *blockingPeer) Delete(ctx context.Context, key string) error {
+	return nil
+}
+
+func (p *blockingPeer) Close() error {
+	p.closed.Store(true)
+	return nil
+}
+
+func TestClose(t *testing.T) {
+	ctx := context.Background()
+	started := make(chan struct{})
+	unblock := make(chan struct{})
+	peer := &blockingPeer{started: make(chan struct{}), unblock: make(chan struct{})}
+	close(peer.unblock)
+	localStore := &closableStore{LRU: lru.New(1 << 20)}
+	var key string
+	cache := distcache.New(distcache.Options{
+		Me:         "me",
+		HotStore:   lru.New(1 << 20),
+		LocalStore: localStore,
+		Getter: distcache.GetterFunc(func(ctx context.Context, k string) ([]byte, time.Duration, error) {
+			if k == key {
+				close(started)
+				<-unblock
+			}
+			return []byte(k), 0, nil
+		}),
+		PeerCreator: peerCreatorFunc(func(addr string) distcache.Peer {
+			return peer
+		}),
+		Peers:       []string{"me", "peer"},
+		CloseStores: true,
+	})
+	key = ownedBy(cache, "me", 0)
+
+	getErr := make(chan error, 1)
+	go func() {
+		_, _, err := cache.Get(ctx, key)
+		getErr <- err
+	}()
+	<-started
+
+	closeErr := make(chan error, 1)
+	go func() {
+		closeErr <- cache.Close(ctx)
+	}()
+	err := retry(func() bool {
+		_, _, err := cache.Get(ctx, "other")
+		return errors.Is(err, distcache.ErrClosed)
+	})
+	if err != nil {
+		t.Fatal("Get didn't return ErrClosed after Close")
+	}
+	if _, err := cache.GetMulti(ctx, []string{"other"}); !errors.Is(err, distcache.ErrClosed) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	select {
+	case <-closeErr:
+		t.Fatal("Close returned with a load in flight")
+	case <-time.After(10 * time.Millisecond):
+	}
+	close(unblock)
+	if err := <-getErr; err != nil {
+		t.Fatalf("unexpected error from in-flight Get: %s", err.Error())
+	}
+	if err := <-closeErr; err != nil {
+		t.Fatalf("unexpected error from Close: %s", err.Error())
+	}
+	if !peer.closed.Load() {
+		t.Fatal("peer not closed")
+	}
+	if !localStore.closed.Load() {
+		t.Fatal("store not closed")
+	}
+	if err := cache.Close(ctx); !errors.Is(err, distcache.ErrClosed) {
+		t.Fatalf("unexpected error closing twice: %v", err)
+	}
+}
+
+func TestCloseTimeout(t *testing.T) {
+	unblock := make(chan struct{})
+	defer close(unblock)
+	started := make(chan struct{})
+	cache := distcache.New(distcache.Options{
+		Me:         "me",
+		HotStore:   lru.New(1 << 20),
+		LocalStore: lru.New(1 << 20),
+		Getter: distcache.GetterFunc(func(ctx context.Context, key string) ([]byte, time.Duration, error) {
+			close(started)
+			<-unblock
+			return []byte(key), 0, nil
+		}),
+		Peers: []string{"me"},
+	})
+	go func() {
+		_, _, _ = cache.Get(context.Background(), "key")
+	}()
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := cache.Close(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+type closableStore struct {
+	*lru.LRU
+	closed atomic.Bool
+}
+
+func (s *closableStore) Close() error {
+	s.closed.Store(true)
+	return nil
+}
+
+func TestPeerEjection(t *testing.T) {
+	ctx := context.Background()
+	peer := &flakyPeer{}
+	peer.fail.Store(true)
+	var mu sync.Mutex
+	var states []distcache.PeerState
+	cache := distcache.New(distcache.Options{
+		Me:         "me",
+		HotStore:   lru.New(1 << 20),
+		LocalStore: lru.New(1 << 20),
+		Getter:     keyGetter(),
+		PeerCreator: peerCreatorFunc(func(addr string) distcache.Peer {
+			return peer
+		}),
+		Peers:     []string{"me", "peer"},
+		Admission: distcache.RandomAdmission(0),
+		Ejection: distcache.Ejection{
+			ConsecutiveFailures: 3,
+			Duration:            50 * time.Millisecond,
+		},
+		Observer: distcache.ObserverFunc(func(ctx context.Context, event distcache.Event) {
+			if e, ok := event.(distcache.PeerHealthEvent); ok {
+				mu.Lock()
+				states = append(states, e.State)
+				mu.Unlock()
+			}
+		}),
+	})
+
+	// Once ejected, the peer's keys go straight to the local Getter.
+	for i := 0; i < 10; i++ {
+		val, src, err := cache.Get(ctx, ownedBy(cache, "peer", i))
+		if err != nil || src != distcache.ResultLocalGet || val == nil {
+			t.Fatalf("unexpected result: %q, %s, %v", val, src, err)
+		}
+	}
+	if n := peer.calls.Load(); n != 3 {
+		t.Fatalf("unexpected number of calls to ejected peer: %d", n)
+	}
+
+	// A failed probe ejects the peer again.
+	time.Sleep(60 * time.Millisecond)
+	_, _, _ = cache.Get(ctx, ownedBy(cache, "peer", 10))
+	_, _, _ = cache.Get(ctx, ownedBy(cache, "peer", 11))
+	if n := peer.calls.Load(); n != 4 {
+		t.Fatalf("unexpected number of calls after failed probe: %d", n)
+	}
+
+	// A successful probe brings the peer back.
+	peer.fail.Store(false)
+	time.Sleep(60 * time.Millisecond)
+	for i := 12; i < 15; i++ {
+		_, src, err := cache.Get(ctx, ownedBy(cache, "peer", i))
+		if err != nil || src != distcache.ResultPeerGet {
+			t.Fatalf("unexpected result from recovered peer: %s, %v", src, err)
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	want := []distcache.PeerState{
+		distcache.PeerEjected,
+		distcache.PeerProbing, distcache.PeerEjected,
+		distcache.PeerProbing, distcache.PeerHealthy,
+	}
+	if !slices.Equal(states, want) {
+		t.Fatalf("unexpected peer states: %v", states)
+	}
+}
+
+type flakyPeer struct {
+	fail  atomic.Bool
+	calls atomic.Int32
+}
+
+func (p *flakyPeer) Get(ctx context.Context, key string) (distcache.Result, error) {
+	p.calls.Add(1)
+	if p.fail.Load() {
+		return distcache.Result{}, errors.New("overloaded")
+	}
+	return distcache.Result{Value: []byte(key), Source: distcache.ResultPeerGet}, nil
+}
+
+func (p *flakyPeer) GetMulti(ctx context.Context, keys []string) (map[string]distcache.Result, error) {
+	return nil, errors.New("not implemented")
+}
+
+func (p *flakyPeer) Delete(ctx context.Context, key string) error {
+	return nil
+}
+
+func (p *flakyPeer) Close() error {
+	return nil
+}
+
+func TestHedging(t *testing.T) {
+	ctx := context.Background()
+	peer := &slowPeer{delay: 30 * time.Millisecond}
+	cache := distcache.New(distcache.Options{
+		Me:         "me",
+		HotStore:   lru.New(1 << 20),
+		LocalStore: lru.New(1 << 20),
+		Getter:     keyGetter(),
+		PeerCreator: peerCreatorFunc(func(addr string) distcache.Peer {
+			return peer
+		}),
+		Peers:     []string{"me", "peer"},
+		Admission: distcache.RandomAdmission(0),
+		Hedging: distcache.Hedging{
+			Percentile: 0.9,
+			MinDelay:   5 * time.Millisecond,
+			Budget:     0.25,
+		},
+	})
+
+	const numGets = 40
+	var hedged int
+	for i := 0; i < numGets; i++ {
+		key := ownedBy(cache, "peer", i)
+		val, src, err := cache.Get(ctx, key)
+		if err != nil || string(val) != key {
+			t.Fatalf("unexpected result: %q, %v", val, err)
+		}
+		switch src {
+		case distcache.ResultHedgedLocalGet:
+			// The budget starts empty, and gains 0.25 per peer request.
+			if hedged++; hedged > (i+1)/4 {
+				t.Fatalf("hedged request %d exceeds the budget", i)
+			}
+		case distcache.ResultPeerGet:
+		default:
+			t.Fatalf("unexpected result source: %s", src)
+		}
+	}
+	if hedged == 0 {
+		t.Fatal("no hedged requests")
+	}
+}
+
+func TestHedgingLatency(t *testing.T) {
+	// Requests cancelled because the hedge answered first still count
+	// towards the peer's latency, so a peer that's always slower than the
+	// hedge is ejected.
+	ctx := context.Background()
+	var mu sync.Mutex
+	var reasons []string
+	cache := distcache.New(distcache.Options{
+		Me:         "me",
+		HotStore:   lru.New(1 << 20),
+		LocalStore: lru.New(1 << 20),
+		Getter:     keyGetter(),
+		PeerCreator: peerCreatorFunc(func(addr string) distcache.Peer {
+			return &slowPeer{delay: time.Second}
+		}),
+		Peers:     []string{"me", "peer"},
+		Admission: distcache.RandomAdmission(0),
+		Hedging: distcache.Hedging{
+			Percentile: 0.9,
+			MinDelay:   5 * time.Millisecond,
+			Budget:     1,
+		},
+		Ejection: distcache.Ejection{
+			LatencyP99:  time.Millisecond,
+			MinRequests: 5,
+		},
+		Observer: distcache.ObserverFunc(func(ctx context.Context, event distcache.Event) {
+			if e, ok := event.(distcache.PeerHealthEvent); ok && e.State == distcache.PeerEjected {
+				mu.Lock()
+				reasons = append(reasons, e.Reason)
+				mu.Unlock()
+			}
+		}),
+	})
+
+	for i := 0; i < 5; i++ {
+		_, src, err := cache.Get(ctx, ownedBy(cache, "peer", i))
+		if err != nil || src != distcache.ResultHedgedLocalGet {
+			t.Fatalf("unexpected result: %s, %v", src, err)
+		}
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(reasons) != 1 || !strings.HasPrefix(reasons[0], "p99 latency") {
+		t.Fatalf("unexpected ejections: %q", reasons)
+	}
+}
+
+// slowPeer answers Get calls after delay, unless cancelled first.
+type slowPeer struct {
+	delay time.Duration
+}
+
+func (p *slowPeer) Get(ctx context.Context, key string) (distcache.Result, error) {
+	select {
+	case <-time.After(p.delay):
+		return distcache.Result{Value: []byte(key), Source: distcache.ResultPeerGet}, nil
+	case <-ctx.Done():
+		return distcache.Result{}, ctx.Err()
+	}
+}
+
+func (p *slowPeer) GetMulti(ctx context.Context, keys []string) (map[string]distcache.Result, error) {
+	return nil, errors.New("not implemented")
+}
+
+func (p *slowPeer) Delete(ctx context.Context, key string) error {
+	return nil
+}
+
+func (p *slowPeer) Close() error {
+	return nil
+}
+
+func TestTyped(t *testing.T) {
+	type user struct {
+		Name string
+		Age  int
+	}
+	ctx := context.Background()
+
+	t.Run("codecs", func(t *testing.T) {
+		getter := distcache.TypedGetterFunc[user](func(ctx context.Context, key string) (user, time.Duration, error) {
+			return user{Name: key, Age: len(key)}, 0, nil
+		})
+		for name, codec := range map[string]distcache.Codec[user]{
+			"json": distcache.JSONCodec[user](),
+			"gob":  distcache.GobCodec[user](),
+		} {
+			cache := distcache.New(distcache.Options{
+				Me:         "me",
+				HotStore:   lru.New(1 << 20),
+				LocalStore: lru.New(1 << 20),
+				Getter:     getter.Getter(codec),
+				Peers:      []string{"me"},
+			})
+			typed := distcache.NewTyped(cache, codec, distcache.TypedOptions{})
+			v, src, err := typed.Get(ctx, "alice")
+			if err != nil {
+				t.Fatalf("%s: unexpected error: %s", name, err.Error())
+			}
+			if v != (user{Name: "alice", Age: 5}) || src != distcache.ResultLocalGet {
+				t.Fatalf("%s: unexpected result: %+v %s", name, v, src)
+			}
+			values, err := typed.GetMulti(ctx, []string{"alice", "bob"})
+			if err != nil {
+				t.Fatalf("%s: unexpected error: %s", name, err.Error())
+			}
+			if len(values) != 2 || values["bob"] != (user{Name: "bob", Age: 3}) {
+				t.Fatalf("%s: unexpected values: %+v", name, values)
+			}
+		}
+	})
+
+	t.Run("proto", func(t *testing.T) {
+		codec := protocodec.New[*wrapperspb.StringValue]()
+		getter := distcache.TypedGetterFunc[*wrapperspb.StringValue](func(ctx context.Context, key string) (*wrapperspb.StringValue, time.Duration, error) {
+			return wrapperspb.String("value-" + key), 0, nil
+		})
+		cache := distcache.New(distcache.Options{
+			Me:         "me",
+			HotStore:   lru.New(1 << 20),
+			LocalStore: lru.New(1 << 20),
+			Getter:     getter.Getter(codec),
+			Peers:      []string{"me"},
+		})
+		typed := distcache.NewTyped(cache, codec, distcache.TypedOptions{})
+		v, _, err := typed.Get(ctx, "key")
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err.Error())
+		}
+		if v.GetValue() != "value-key" {
+			t.Fatalf("unexpected value: %q", v.GetValue())
+		}
+	})
+
+	t.Run("decode error", func(t *testing.T) {
+		cache := distcache.New(distcache.Options{
+			Me:         "me",
+			HotStore:   lru.New(1 << 20),
+			LocalStore: lru.New(1 << 20),
+			Getter:     &batchGetter{},
+			Peers:      []string{"me"},
+		})
+		typed := distcache.NewTyped(cache, distcache.JSONCodec[user](), distcache.TypedOptions{})
+		if _, _, err := typed.Get(ctx, "key"); err == nil {
+			t.Fatal("expected decode error")
+		}
+		_, err := typed.GetMulti(ctx, []string{"a", "b"})
+		var errs distcache.KeyErrors
+		if !errors.As(err, &errs) || len(errs) != 2 {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+
+	t.Run("nil values", func(t *testing.T) {
+		cache := distcache.New(distcache.Options{
+			Me:         "me",
+			HotStore:   lru.New(1 << 20),
+			LocalStore: lru.New(1 << 20),
+			Getter:     emptyBatchGetter{},
+			Peers:      []string{"me"},
+		})
+		typed := distcache.NewTyped(cache, distcache.JSONCodec[user](), distcache.TypedOptions{MemoSize: 10})
+		values, err := typed.GetMulti(ctx, []string{"a", "b"})
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err.Error())
+		}
+		if len(values) != 2 || values["a"] != (user{}) {
+			t.Fatalf("unexpected values: %+v", values)
+		}
+	})
+
+	t.Run("memo", func(t *testing.T) {
+		// The local store returns a copy of each value, so the memo can't
+		// rely on getting the same bytes back.
+		localStore := distcache.CompressedStore(lru.New(1<<20), distcache.CompressionOptions{})
+		codec := &countingCodec[user]{Codec: distcache.JSONCodec[user]()}
+		getter := distcache.TypedGetterFunc[user](func(ctx context.Context, key string) (user, time.Duration, error) {
+			return user{Name: key}, 0, nil
+		})
+		cache := distcache.New(distcache.Options{
+			Me:         "me",
+			HotStore:   lru.New(1 << 20),
+			LocalStore: localStore,
+			Getter:     getter.Getter(codec),
+			Peers:      []string{"me"},
+		})
+		typed := distcache.NewTyped[user](cache, codec, distcache.TypedOptions{MemoSize: 1})
+		for i := 0; i < 3; i++ {
+			if _, _, err := typed.Get(ctx, "alice"); err != nil {
+				t.Fatalf("unexpected error: %s", err.Error())
+			}
+		}
+		// Only the loaded value is decoded, and cache hits for the same bytes
+		// are memoized.
+		if n := codec.unmarshals.Load(); n != 1 {
+			t.Fatalf("unexpected number of decodes: %d", n)
+		}
+
+		// Replacing the value must invalidate the memoized value.
+		_ = localStore.Set(ctx, "alice", []byte(`{"Name":"bob"}`), 0)
+		v, _, err := typed.Get(ctx, "alice")
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err.Error())
+		}
+		if v.Name != "bob" {
+			t.Fatalf("unexpected value: %+v", v)
+		}
+
+		// Memoized values are evicted beyond MemoSize.
+		_, _, _ = typed.Get(ctx, "carol")
+		_, _, _ = typed.Get(ctx, "carol")
+		before := codec.unmarshals.Load()
+		_, _, _ = typed.Get(ctx, "alice")
+		if n := codec.unmarshals.Load(); n != before+1 {
+			t.Fatalf("expected evicted value to be decoded again")
+		}
+	})
+}
+
+// emptyBatchGetter is a BatchGetter that returns nil values for every key.
+type emptyBatchGetter struct{}
+
+func (emptyBatchGetter) Get(ctx context.Context, key string) ([]byte, time.Duration, error) {
+	return nil, 0, nil
+}
+
+func (emptyBatchGetter) GetMulti(ctx context.Context, keys []string) (map[string]distcache.Entry, error) {
+	return map[string]distcache.Entry{}, nil
+}
+
+type countingCodec[T any] struct {
+	distcache.Codec[T]
+	unmarshals atomic.Int32
+}
+
+func (c *countingCodec[T]) Unmarshal(data []byte) (T, error) {
+	c.unmarshals.Add(1)
+	return c.Codec.Unmarshal(data)
+}
+
+func TestCompressedStore(t *testing.T) {
+	ctx := context.Background()
+	large := bytes.Repeat([]byte(`{"key":"value"}`), 100)
+
+	for _, comp := range []distcache.Compressor{distcache.Gzip(gzip.BestSpeed), distcache.Flate(flate.DefaultCompression)} {
+		t.Run(comp.Name(), func(t *testing.T) {
+			lruStore := lru.New(1 << 20)
+			store := distcache.CompressedStore(lruStore, distcache.CompressionOptions{Compressor: comp, MinSize: 64})
+
+			_ = store.Set(ctx, "large", large, time.Minute)
+			_ = store.Set(ctx, "small", []byte("small"), 0)
+			_ = store.Set(ctx, "empty", []byte{}, 0)
+
+			// Values are accounted for at their compressed size.
+			if n := lruStore.Size(); n >= len(large) {
+				t.Fatalf("unexpected store size: %d", n)
+			}
+			if raw, _, _ := lruStore.Get(ctx, "small"); len(raw) != len("small")+1 {
+				t.Fatalf("unexpected raw value: %q", raw)
+			}
+
+			for key, want := range map[string][]byte{"large": large, "small": []byte("small"), "empty": {}} {
+				val, _, err := store.Get(ctx, key)
+				if err != nil {
+					t.Fatalf("unexpected error: %s", err.Error())
+				}
+				if val == nil || !bytes.Equal(val, want) {
+					t.Fatalf("unexpected value for %q: %q", key, val)
+				}
+			}
+			_ = store.Set(ctx, "nil", nil, 0)
+			for _, key := range []string{"missing", "nil"} {
+				if val, _, _ := store.Get(ctx, key); val != nil {
+					t.Fatalf("unexpected value for %q: %q", key, val)
+				}
+			}
+
+			var ranged int
+			store.(distcache.Ranger).Range(func(key string, val []byte) bool {
+				if key == "large" && !bytes.Equal(val, large) {
+					t.Fatalf("unexpected ranged value: %q", val)
+				}
+				ranged++
+				return true
+			})
+			if ranged != 3 {
+				t.Fatalf("unexpected number of ranged entries: %d", ranged)
+			}
+		})
+	}
+
+	testWrapperInterfaces(t, func(store distcache.Store) distcache.Store {
+		return distcache.CompressedStore(store, distcache.CompressionOptions{})
+	})
+}
+
+// testWrapperInterfaces checks that a Store wrapper is only a Ranger or
+// io.Closer when the Store it wraps is.
+func testWrapperInterfaces(t *testing.T, wrap func(distcache.Store) distcache.Store) {
+	t.Helper()
+	for _, tc := range []struct {
+		store          distcache.Store
+		ranger, closer bool
+	}{
+		{struct{ distcache.Store }{lru.New(1 << 10)}, false, false},
+		{lru.New(1 << 10), true, false},
+		{struct {
+			distcache.Store
+			io.Closer
+		}{lru.New(1 << 10), &closableStore{}}, false, true},
+		{&closableStore{LRU: lru.New(1 << 10)}, true, true},
+	} {
+		wrapped := wrap(tc.store)
+		if _, ok := wrapped.(distcache.Ranger); ok != tc.ranger {
+			t.Fatalf("unexpected Ranger for %T: %t", tc.store, ok)
+		}
+		closer, ok := wrapped.(io.Closer)
+		if ok != tc.closer {
+			t.Fatalf("unexpected io.Closer for %T: %t", tc.store, ok)
+		}
+		if cs, isClosable := tc.store.(*closableStore); isClosable {
+			_ = closer.Close()
+			if !cs.closed.Load() {
+				t.Fatal("expected wrapped store to be closed")
+			}
+		}
+	}
+}
+
+func TestEncryptedStore(t *testing.T) {
+	ctx := context.Background()
+	lruStore := lru.New(1 << 20)
+	keys := distcache.NewKeyRing(1, bytes.Repeat([]byte{1}, 32))
+	store := distcache.EncryptedStore(lruStore, keys)
+
+	secret := []byte("secret value")
+	_ = store.Set(ctx, "key1", secret, time.Minute)
+	_ = store.Set(ctx, "key2", []byte("other value"), 0)
+
+	raw1, _, _ := lruStore.Get(ctx, "key1")
+	if bytes.Contains(raw1, secret) {
+		t.Fatal("value stored in plaintext")
+	}
+	val, ttl, err := store.Get(ctx, "key1")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	if !bytes.Equal(val, secret) || ttl <= 0 {
+		t.Fatalf("unexpected value: %q %s", val, ttl)
+	}
+
+	// Empty values aren't misses, but nil values aren't stored.
+	_ = store.Set(ctx, "empty", []byte{}, 0)
+	if val, _, err := store.Get(ctx, "empty"); err != nil || val == nil || len(val) != 0 {
+		t.Fatalf("unexpected empty value: %q, %v", val, err)
+	}
+	_ = store.Set(ctx, "nil", nil, 0)
+	if val, _, err := store.Get(ctx, "nil"); err != nil || val != nil {
+		t.Fatalf("unexpected nil value: %q, %v", val, err)
+	}
+
+	// Values can't be swapped between keys.
+	_ = lruStore.Set(ctx, "key2", raw1, 0)
+	if _, _, err := store.Get(ctx, "key2"); err == nil {
+		t.Fatal("expected error for swapped value")
+	}
+
+	// After rotating, old values are still readable and are re-encrypted with
+	// the new key when read.
+	keys.Rotate(2, bytes.Repeat([]byte{2}, 16))
+	val, _, err = store.Get(ctx, "key1")
+	if err != nil || !bytes.Equal(val, secret) {
+		t.Fatalf("unexpected result after rotation: %q, %v", val, err)
+	}
+	raw2, ttl, _ := lruStore.Get(ctx, "key1")
+	if bytes.Equal(raw1, raw2) || ttl <= 0 {
+		t.Fatal("expected value to be re-encrypted with its TTL")
+	}
+	keys.Remove(1)
+	val, _, err = store.Get(ctx, "key1")
+	if err != nil || !bytes.Equal(val, secret) {
+		t.Fatalf("unexpected result after removing old key: %q, %v", val, err)
+	}
+	_ = lruStore.Set(ctx, "key1", raw1, 0)
+	if _, _, err := store.Get(ctx, "key1"); !errors.Is(err, distcache.ErrUnknownKey) {
+		t.Fatalf("unexpected error for removed key: %v", err)
+	}
+
+	var ranged []string
+	_ = store.Set(ctx, "key3", []byte("value3"), 0)
+	store.(distcache.Ranger).Range(func(key string, val []byte) bool {
+		ranged = append(ranged, key+"="+string(val))
+		return true
+	})
+	if !slices.Equal(ranged, []string{"key3=value3"}) {
+		t.Fatalf("unexpected ranged entries: %v", ranged)
+	}
+
+	invalid := distcache.EncryptedStore(lru.New(1<<20), distcache.NewKeyRing(1, []byte("short")))
+	if err := invalid.Set(ctx, "key", []byte("value"), 0); err == nil {
+		t.Fatal("expected error for invalid key size")
+	}
+
+	testWrapperInterfaces(t, func(store distcache.Store) distcache.Store {
+		return distcache.EncryptedStore(store, keys)
+	})
+}
+
+type memTracer struct {
+	mu    sync.Mutex
+	spans []*memSpan
+}
+
+type memSpanKey struct{}
+
+func (mt *memTracer) Start(ctx context.Context, name string) (context.Context, distcache.Span) {
+	parent, _ := ctx.Value(memSpanKey{}).(*memSpan)
+	span := &memSpan{tracer: mt, name: name, parent: parent, attrs: make(map[string]string)}
+	mt.mu.Lock()
+	mt.spans = append(mt.spans, span)
+	mt.mu.Unlock()
+	return context.WithValue(ctx, memSpanKey{}, span), span
+}
+
+func (mt *memTracer) Inject(ctx context.Context, carrier map[string]string) {}
+
+func (mt *memTracer) Extract(ctx context.Context, carrier map[string]string) context.Context {
+	return ctx
+}
+
+type memSpan struct {
+	tracer *memTracer
+	name   string
+	parent *memSpan
+	attrs  map[string]string
+	ended  bool
+}
+
+func (ms *memSpan) SetAttributes(attrs ...distcache.Attribute) {
+	ms.tracer.mu.Lock()
+	defer ms.tracer.mu.Unlock()
+	for _, attr := range attrs {
+		ms.attrs[attr.Key] = attr.Value
+	}
+}
+
+func (ms *memSpan) RecordError(err error) {}
+
+func (ms *memSpan) End() {
+	ms.tracer.mu.Lock()
+	defer ms.tracer.mu.Unlock()
+	ms.ended = true
+}
+
+func retry(fn func() bool) error {
+	deadline := time.Now().Add(10 * time.Second)
+	for !fn() {
+		if time.Now().After(deadline) {
+			return errors.New("timed out")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return nil
+}
+
+func keyGetter() distcache.GetterFunc {
+	return func(ctx context.Context, key string) ([]byte, time.Duration, error) {
+		return []byte(key), 0, nil
+	}
+}
+
+type mockPeers struct {
+	mu        sync.Mutex
+	deleted   map[string][]string
+	gets      map[string]int
+	multiGets map[string]int
+	handoffs  map[string]map[string]distcache.Entry
+}
+
+func newMockPeers() *mockPeers {
+	return &mockPeers{
+		deleted:   make(map[string][]string),
+		gets:      make(map[string]int),
+		multiGets: make(map[string]int),
+		handoffs:  make(map[string]map[string]distcache.Entry),
+	}
+}
+
+func (m *mockPeers) NewPeer(addr string) distcache.Peer {
+	return &mockPeer{addr: addr, peers: m}
+}
+
+func (m *mockPeers) deletedFrom(key string) []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	addrs := append([]string(nil), m.deleted[key]...)
+	sort.Strings(addrs)
+	return addrs
+}
+
+type mockPeer struct {
+	addr  string
+	peers *mockPeers
+}
+
+func (p *mockPeer) Get(ctx context.Context, key string) (distcache.Result, error) {
+	p.peers.mu.Lock()
+	p.peers.gets[p.addr]++
+	p.peers.mu.Unlock()
+	return distcache.Result{Value: []byte(key), Source: distcache.ResultPeerGet}, nil
+}
+
+func (p *mockPeer) GetMulti(ctx context.Context, keys []string) (map[string]distcache.Result, error) {
+	p.peers.mu.Lock()
+	p.peers.multiGets[p.addr]++
+	p.peers.mu.Unlock()
+	results := make(map[string]distcache.Result, len(keys))
+	for _, key := range keys {
+		results[key] = distcache.Result{Value: []byte(key), Source: distcache.ResultPeerGet}
+	}
+	return results, nil
+}
+
+func (p *mockPeer) Delete(ctx context.Context, key string) error {
+	p.peers.mu.Lock()
+	defer p.peers.mu.Unlock()
+	p.peers.deleted[key] = append(p.peers.deleted[key], p.addr)
+	return nil
+}
+
+func (p *mockPeer) Handoff(ctx context.Context, entries map[string]distcache.Entry) error {
+	p.peers.mu.Lock()
+	defer p.peers.mu.Unlock()
+	if p.peers.handoffs[p.addr] == nil {
+		p.peers.handoffs[p.addr] = make(map[string]distcache.Entry)
+	}
+	for key, entry := range entries {
+		p.peers.handoffs[p.addr][key] = entry
+	}
+	return nil
+}
+
+func (p *mockPeer) Close() error {
+	return nil
+}
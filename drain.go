@@ -0,0 +1,113 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2020 Ryan Fowler
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package distcache
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// defaultDrainTimeout is how long removed peers are given to finish in-flight
+// requests when Options.DrainTimeout isn't set.
+const defaultDrainTimeout = 10 * time.Second
+
+// peerHandle counts the in-flight requests to a Peer, so that it's only
+// closed after they finish once it's removed.
+type peerHandle struct {
+	Peer
+	health *peerHealth
+
+	mu      sync.Mutex
+	refs    int
+	removed bool
+	drained chan struct{}
+}
+
+func newPeerHandle(peer Peer, health *peerHealth) *peerHandle {
+	return &peerHandle{Peer: peer, health: health, drained: make(chan struct{})}
+}
+
+// acquire returns whether the peer can be used for a new request, which must
+// then be followed by a call to release.
+func (p *peerHandle) acquire() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.removed {
+		return false
+	}
+	p.refs++
+	return true
+}
+
+func (p *peerHandle) release() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.refs--
+	if p.refs == 0 && p.removed {
+		close(p.drained)
+	}
+}
+
+// remove stops the peer from being acquired.
+func (p *peerHandle) remove() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.removed {
+		return
+	}
+	p.removed = true
+	if p.refs == 0 {
+		close(p.drained)
+	}
+}
+
+type peerMap map[string]*peerHandle
+
+// acquire returns the peer at addr, if it exists and can be used for a new
+// request.
+func (m peerMap) acquire(addr string) (*peerHandle, bool) {
+	peer, ok := m[addr]
+	if !ok || !peer.acquire() {
+		return nil, false
+	}
+	return peer, true
+}
+
+// drainPeer closes a removed peer once its in-flight requests finish, or the
+// drain timeout expires.
+func (c *Cache) drainPeer(addr string, peer *peerHandle) {
+	peer.remove()
+	c.draining.Add(1)
+	go func() {
+		defer c.draining.Done()
+		timer := time.NewTimer(c.drainTimeout)
+		defer timer.Stop()
+		select {
+		case <-peer.drained:
+		case <-timer.C:
+		}
+		err := peer.Close()
+		c.observe(context.Background(), PeerRemovedEvent{Peer: addr, Err: err})
+	}()
+}
@@ -0,0 +1,277 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2020 Ryan Fowler
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package distcache
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"sync"
+	"time"
+)
+
+// KeyProvider supplies the keys used by an encrypted Store. Keys must be 16,
+// 24 or 32 bytes long to select AES-128, AES-192 or AES-256, and the key for
+// an ID must never change.
+type KeyProvider interface {
+	// CurrentKey returns the key used to encrypt new values, and its ID.
+	CurrentKey(ctx context.Context) (uint32, []byte, error)
+	// Key returns the key with the provided ID, used to decrypt values that
+	// were encrypted before the current key was rotated in.
+	Key(ctx context.Context, id uint32) ([]byte, error)
+}
+
+// ErrUnknownKey is returned by a KeyRing for key IDs that it doesn't have.
+var ErrUnknownKey = errors.New("unknown encryption key")
+
+// KeyRing is a KeyProvider that holds keys in memory.
+type KeyRing struct {
+	mu      sync.RWMutex
+	current uint32
+	keys    map[uint32][]byte
+}
+
+// NewKeyRing returns a KeyRing that encrypts with key, identified by id.
+func NewKeyRing(id uint32, key []byte) *KeyRing {
+	return &KeyRing{current: id, keys: map[uint32][]byte{id: key}}
+}
+
+// Rotate adds key, identified by id, and makes it the current key. Previous
+// keys are kept for decryption until they are removed.
+func (kr *KeyRing) Rotate(id uint32, key []byte) {
+	kr.mu.Lock()
+	defer kr.mu.Unlock()
+	kr.current = id
+	kr.keys[id] = key
+}
+
+// Remove removes the key with the provided ID, unless it's the current key.
+// Values encrypted with a removed key can no longer be read.
+func (kr *KeyRing) Remove(id uint32) {
+	kr.mu.Lock()
+	defer kr.mu.Unlock()
+	if id != kr.current {
+		delete(kr.keys, id)
+	}
+}
+
+func (kr *KeyRing) CurrentKey(ctx context.Context) (uint32, []byte, error) {
+	kr.mu.RLock()
+	defer kr.mu.RUnlock()
+	return kr.current, kr.keys[kr.current], nil
+}
+
+func (kr *KeyRing) Key(ctx context.Context, id uint32) ([]byte, error) {
+	kr.mu.RLock()
+	defer kr.mu.RUnlock()
+	key, ok := kr.keys[id]
+	if !ok {
+		return nil, ErrUnknownKey
+	}
+	return key, nil
+}
+
+var errInvalidCiphertext = errors.New("invalid encrypted value")
+
+// encryptedLocks is the number of lock stripes serializing writes to keys
+// with lazy re-encryption.
+const encryptedLocks = 64
+
+// EncryptedStore returns a Store that encrypts the values stored in store
+// with AES-GCM, using the keys from keys. Each value is bound to its cache key
+// as associated data, so values can't be swapped between keys. Values
+// encrypted with a key other than the current one are re-encrypted with the
+// current key when read.
+//
+// Encrypted values don't compress, so a compressed Store should wrap the
+// encrypted Store rather than the other way around. Ranging over the returned
+// Store, which decrypts each value, and closing it are only possible when
+// store supports them.
+func EncryptedStore(store Store, keys KeyProvider) Store {
+	es := &encryptedStore{store: store, keys: keys}
+	return wrapStore(store, es, es.rangeValues)
+}
+
+type encryptedStore struct {
+	store Store
+	keys  KeyProvider
+	locks [encryptedLocks]sync.Mutex
+
+	mu    sync.Mutex
+	aeads map[uint32]cachedAEAD
+}
+
+func (es *encryptedStore) Get(ctx context.Context, key string) ([]byte, time.Duration, error) {
+	data, ttl, err := es.store.Get(ctx, key)
+	if err != nil || data == nil {
+		return data, ttl, err
+	}
+	val, id, err := es.decrypt(ctx, key, data)
+	if err != nil {
+		return nil, 0, err
+	}
+	if current, _, err := es.keys.CurrentKey(ctx); err == nil && current != id {
+		es.reencrypt(ctx, key, data, val, ttl)
+	}
+	return val, ttl, nil
+}
+
+func (es *encryptedStore) Set(ctx context.Context, key string, val []byte, ttl time.Duration) error {
+	if val == nil {
+		return nil
+	}
+	data, err := es.encrypt(ctx, key, val)
+	if err != nil {
+		return err
+	}
+	mu := es.lock(key)
+	mu.Lock()
+	defer mu.Unlock()
+	return es.store.Set(ctx, key, data, ttl)
+}
+
+func (es *encryptedStore) Delete(ctx context.Context, key string) error {
+	mu := es.lock(key)
+	mu.Lock()
+	defer mu.Unlock()
+	return es.store.Delete(ctx, key)
+}
+
+// rangeValues calls fn with the decrypted value of each entry in the
+// underlying Ranger, skipping values that fail to decrypt.
+func (es *encryptedStore) rangeValues(fn func(key string, val []byte) bool) {
+	ctx := context.Background()
+	es.store.(Ranger).Range(func(key string, data []byte) bool {
+		val, _, err := es.decrypt(ctx, key, data)
+		if err != nil {
+			return true
+		}
+		return fn(key, val)
+	})
+}
+
+// reencrypt replaces data, read for key, with val encrypted with the current
+// key. The value is only replaced if it hasn't changed since it was read.
+func (es *encryptedStore) reencrypt(ctx context.Context, key string, data, val []byte, ttl time.Duration) {
+	out, err := es.encrypt(ctx, key, val)
+	if err != nil {
+		return
+	}
+	mu := es.lock(key)
+	mu.Lock()
+	defer mu.Unlock()
+	if latest, _, err := es.store.Get(ctx, key); err != nil || !bytes.Equal(latest, data) {
+		return
+	}
+	_ = es.store.Set(ctx, key, out, ttl)
+}
+
+func (es *encryptedStore) lock(key string) *sync.Mutex {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(key))
+	return &es.locks[h.Sum32()%encryptedLocks]
+}
+
+// Encrypted values are laid out as the key ID, the nonce and the ciphertext.
+// The associated data is the key ID followed by the cache key.
+func (es *encryptedStore) encrypt(ctx context.Context, key string, val []byte) ([]byte, error) {
+	id, secret, err := es.keys.CurrentKey(ctx)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := es.aead(id, secret)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]byte, 4+aead.NonceSize(), 4+aead.NonceSize()+len(val)+aead.Overhead())
+	binary.BigEndian.PutUint32(out, id)
+	if _, err := rand.Read(out[4:]); err != nil {
+		return nil, err
+	}
+	return aead.Seal(out, out[4:], val, associatedData(id, key)), nil
+}
+
+func (es *encryptedStore) decrypt(ctx context.Context, key string, data []byte) ([]byte, uint32, error) {
+	if len(data) < 4 {
+		return nil, 0, errInvalidCiphertext
+	}
+	id := binary.BigEndian.Uint32(data)
+	secret, err := es.keys.Key(ctx, id)
+	if err != nil {
+		return nil, 0, err
+	}
+	aead, err := es.aead(id, secret)
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(data) < 4+aead.NonceSize() {
+		return nil, 0, errInvalidCiphertext
+	}
+	nonce, ciphertext := data[4:4+aead.NonceSize()], data[4+aead.NonceSize():]
+	// Open into a non-nil slice, so that an empty value isn't a miss.
+	buf := make([]byte, 0, max(0, len(ciphertext)-aead.Overhead()))
+	val, err := aead.Open(buf, nonce, ciphertext, associatedData(id, key))
+	if err != nil {
+		return nil, 0, errInvalidCiphertext
+	}
+	return val, id, nil
+}
+
+// aead returns the AEAD for secret, reusing the cached AEAD for the key ID.
+func (es *encryptedStore) aead(id uint32, secret []byte) (cipher.AEAD, error) {
+	es.mu.Lock()
+	defer es.mu.Unlock()
+	if c, ok := es.aeads[id]; ok && bytes.Equal(c.secret, secret) {
+		return c.aead, nil
+	}
+	block, err := aes.NewCipher(secret)
+	if err != nil {
+		return nil, fmt.Errorf("encryption key %d: %w", id, err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	if es.aeads == nil {
+		es.aeads = make(map[uint32]cachedAEAD)
+	}
+	es.aeads[id] = cachedAEAD{secret: bytes.Clone(secret), aead: aead}
+	return aead, nil
+}
+
+type cachedAEAD struct {
+	secret []byte
+	aead   cipher.AEAD
+}
+
+func associatedData(id uint32, key string) []byte {
+	ad := make([]byte, 4, 4+len(key))
+	binary.BigEndian.PutUint32(ad, id)
+	return append(ad, key...)
+}
@@ -0,0 +1,161 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2020 Ryan Fowler
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package distcache
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// flightGroup wraps a singleflight.Group so that calls run under their own
+// context, rather than the context of whichever caller started them. A call's
+// context keeps the values of the first caller's context, and is cancelled
+// once every caller waiting on it has released it, or after timeout.
+type flightGroup struct {
+	group   singleflight.Group
+	timeout time.Duration
+
+	mu     sync.Mutex
+	calls  map[string]*flightCall
+	closed bool
+	active sync.WaitGroup
+}
+
+type flightCall struct {
+	waiters int
+	cancel  context.CancelFunc
+}
+
+// DoChan is like singleflight.Group.DoChan, additionally reporting whether it
+// started a new call or joined one already in flight. The returned release
+// function must be called once the caller is no longer interested in the
+// result. Once the group is closed, calls fail with ErrClosed.
+func (g *flightGroup) DoChan(ctx context.Context, key string, fn func(context.Context) (interface{}, error)) (<-chan singleflight.Result, bool, func()) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.closed {
+		ch := make(chan singleflight.Result, 1)
+		ch <- singleflight.Result{Err: ErrClosed}
+		return ch, false, func() {}
+	}
+
+	if call, ok := g.calls[key]; ok {
+		call.waiters++
+		ch := g.group.DoChan(key, func() (interface{}, error) {
+			// Never called, as the key is already in flight.
+			return fn(ctx)
+		})
+		return ch, false, g.releaseFunc(key, call)
+	}
+
+	ctx, cancel := g.newContext(ctx)
+	call := &flightCall{waiters: 1, cancel: cancel}
+	if g.calls == nil {
+		g.calls = make(map[string]*flightCall)
+	}
+	g.calls[key] = call
+	g.active.Add(1)
+	ch := g.group.DoChan(key, func() (interface{}, error) {
+		defer g.active.Done()
+		defer g.done(key, call)
+		return fn(ctx)
+	})
+	return ch, true, g.releaseFunc(key, call)
+}
+
+// newContext returns a context for a call that keeps the values of ctx, but
+// not its cancellation.
+func (g *flightGroup) newContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	ctx = context.WithoutCancel(ctx)
+	if g.timeout > 0 {
+		return context.WithTimeout(ctx, g.timeout)
+	}
+	return context.WithCancel(ctx)
+}
+
+// close stops new calls from starting, and waits for those in flight to
+// finish.
+func (g *flightGroup) close(ctx context.Context) error {
+	g.mu.Lock()
+	g.closed = true
+	g.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		g.active.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (g *flightGroup) Forget(key string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.group.Forget(key)
+	delete(g.calls, key)
+}
+
+func (g *flightGroup) releaseFunc(key string, call *flightCall) func() {
+	var once sync.Once
+	return func() {
+		once.Do(func() { g.release(key, call) })
+	}
+}
+
+func (g *flightGroup) release(key string, call *flightCall) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	call.waiters--
+	if call.waiters > 0 {
+		return
+	}
+	// Nobody is waiting on the result anymore, so cancel the call and make
+	// sure that new callers don't join it.
+	call.cancel()
+	g.remove(key, call)
+}
+
+func (g *flightGroup) done(key string, call *flightCall) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	call.cancel()
+	g.remove(key, call)
+}
+
+func (g *flightGroup) remove(key string, call *flightCall) {
+	if g.calls[key] == call {
+		// Forget the key in the group as well, so that the next call to
+		// DoChan starts a new call, as reported.
+		g.group.Forget(key)
+		delete(g.calls, key)
+	}
+}
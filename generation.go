@@ -0,0 +1,77 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2020 Ryan Fowler
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package distcache
+
+import (
+	"context"
+	"sync/atomic"
+)
+
+// deletionStripes is the number of stripes that keys are hashed into to track
+// when they were last deleted. Keys sharing a stripe may occasionally cause a
+// load not to be cached, but never cause a deleted value to be cached.
+const deletionStripes = 256
+
+// deletions tracks when keys were deleted, so that loads that were already in
+// flight don't write the old value back to the stores.
+type deletions struct {
+	epoch   atomic.Uint64
+	stripes [deletionStripes]atomic.Uint64
+}
+
+type loadEpochKey struct{}
+
+// startLoad returns ctx recording the current epoch, for checking whether
+// the keys being loaded are deleted before their values are stored.
+func (d *deletions) startLoad(ctx context.Context) context.Context {
+	return context.WithValue(ctx, loadEpochKey{}, d.epoch.Load())
+}
+
+// markDeleted records that key was deleted, invalidating any in-flight loads
+// for it.
+func (d *deletions) markDeleted(key string) {
+	epoch := d.epoch.Add(1)
+	stripe := &d.stripes[deletionStripe(key)]
+	for {
+		old := stripe.Load()
+		if old >= epoch || stripe.CompareAndSwap(old, epoch) {
+			return
+		}
+	}
+}
+
+// deletedSince returns whether key was deleted after the load in ctx started.
+func (d *deletions) deletedSince(ctx context.Context, key string) bool {
+	start, ok := ctx.Value(loadEpochKey{}).(uint64)
+	return ok && d.stripes[deletionStripe(key)].Load() > start
+}
+
+func deletionStripe(key string) uint32 {
+	// FNV-1a.
+	h := uint32(2166136261)
+	for i := 0; i < len(key); i++ {
+		h ^= uint32(key[i])
+		h *= 16777619
+	}
+	return h % deletionStripes
+}
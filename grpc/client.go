@@ -24,19 +24,28 @@ package grpc
 
 import (
 	"context"
+	"errors"
 
 	"github.com/ryanfowler/distcache"
 	pb "github.com/ryanfowler/distcache/grpc/peerpb/v1"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
-var _ distcache.Peer = (*Client)(nil)
+var (
+	_ distcache.HandoffPeer = (*Client)(nil)
+	_ distcache.ReplicaPeer = (*Client)(nil)
+)
 
 type Client struct {
 	err     error
 	address string
 	client  pb.PeerServiceClient
 	conn    *grpc.ClientConn
+	tracer  distcache.Tracer
+
+	compression Compression
 }
 
 func NewClient(ctx context.Context, addr string, opts ...grpc.DialOption) *Client {
@@ -51,29 +60,116 @@ func NewClient(ctx context.Context, addr string, opts ...grpc.DialOption) *Clien
 	}
 }
 
-func (c *Client) Get(ctx context.Context, key string) ([]byte, distcache.ResultSource, error) {
+func (c *Client) Get(ctx context.Context, key string) (distcache.Result, error) {
 	if c.err != nil {
-		return nil, distcache.ResultNone, c.err
+		return distcache.Result{}, c.err
 	}
 
 	count := getRequestCount(ctx)
 	count++
 	if count > maxRequestCount {
-		return nil, distcache.ResultNone, errMaxRequestCountExceeded
+		return distcache.Result{}, errMaxRequestCountExceeded
 	}
 
-	res, err := c.client.Get(ctx, &pb.GetRequest{
+	res, err := c.client.Get(injectTrace(ctx, c.tracer), &pb.GetRequest{
 		Key:              key,
 		PeerRequestCount: int32(count),
+		AcceptEncodings:  c.compression.names(),
 	})
 	if err != nil {
-		return nil, distcache.ResultNone, err
+		return distcache.Result{}, fromStatus(err)
+	}
+	val, err := c.compression.decode(res.Value, res.Encoding)
+	if err != nil {
+		return distcache.Result{}, err
 	}
 	resSrc := distcache.ResultPeerGet
 	if res.CacheHit {
 		resSrc = distcache.ResultPeerCache
 	}
-	return res.Value, resSrc, nil
+	return distcache.Result{
+		Value:  val,
+		Source: resSrc,
+		TTL:    millisToDuration(res.TtlMs),
+	}, nil
+}
+
+func (c *Client) GetMulti(ctx context.Context, keys []string) (map[string]distcache.Result, error) {
+	if c.err != nil {
+		return nil, c.err
+	}
+
+	count := getRequestCount(ctx)
+	count++
+	if count > maxRequestCount {
+		return nil, errMaxRequestCountExceeded
+	}
+
+	res, err := c.client.GetMulti(injectTrace(ctx, c.tracer), &pb.GetMultiRequest{
+		Keys:             keys,
+		PeerRequestCount: int32(count),
+		AcceptEncodings:  c.compression.names(),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	results := make(map[string]distcache.Result, len(res.Results))
+	var errs distcache.KeyErrors
+	for _, r := range res.Results {
+		val, err := c.compression.decode(r.Value, r.Encoding)
+		if r.NotFound || r.Error != "" || err != nil {
+			if errs == nil {
+				errs = make(distcache.KeyErrors)
+			}
+			switch {
+			case r.NotFound:
+				errs[r.Key] = distcache.ErrNotFound
+			case r.Error != "":
+				errs[r.Key] = errors.New(r.Error)
+			default:
+				errs[r.Key] = err
+			}
+			continue
+		}
+		resSrc := distcache.ResultPeerGet
+		if r.CacheHit {
+			resSrc = distcache.ResultPeerCache
+		}
+		results[r.Key] = distcache.Result{
+			Value:  val,
+			Source: resSrc,
+			TTL:    millisToDuration(r.TtlMs),
+		}
+	}
+	if errs != nil {
+		return results, errs
+	}
+	return results, nil
+}
+
+func (c *Client) Delete(ctx context.Context, key string) error {
+	if c.err != nil {
+		return c.err
+	}
+	_, err := c.client.Delete(injectTrace(ctx, c.tracer), &pb.DeleteRequest{Key: key})
+	return err
+}
+
+func (c *Client) Handoff(ctx context.Context, entries map[string]distcache.Entry) error {
+	if c.err != nil {
+		return c.err
+	}
+	_, err := c.client.Handoff(injectTrace(ctx, c.tracer), &pb.HandoffRequest{Entries: toEntries(entries)})
+	return err
+}
+
+func (c *Client) Replicate(ctx context.Context, entries map[string]distcache.Entry) error {
+	if c.err != nil {
+		return c.err
+	}
+	_, err := c.client.Replicate(injectTrace(ctx, c.tracer), &pb.ReplicateRequest{Entries: toEntries(entries)})
+	return err
 }
 
 func (c *Client) Close() error {
@@ -83,3 +179,12 @@ func (c *Client) Close() error {
 func (c *Client) String() string {
 	return c.address
 }
+
+// fromStatus converts an error returned from a peer into ErrNotFound if the
+// key doesn't exist.
+func fromStatus(err error) error {
+	if status.Code(err) == codes.NotFound {
+		return distcache.ErrNotFound
+	}
+	return err
+}
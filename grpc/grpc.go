@@ -25,17 +25,94 @@ package grpc
 import (
 	"context"
 	"errors"
+	"fmt"
+	"slices"
+	"time"
 
 	"github.com/ryanfowler/distcache"
+	pb "github.com/ryanfowler/distcache/grpc/peerpb/v1"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
 )
 
 type PeerCreator struct {
 	DialOptions []grpc.DialOption
+	// Tracer, if set, is used to propagate trace context to peers.
+	Tracer distcache.Tracer
+	// Compression, if set, is offered to peers for the values they return.
+	Compression Compression
 }
 
 func (pc *PeerCreator) NewPeer(addr string) distcache.Peer {
-	return NewClient(context.Background(), addr, pc.DialOptions...)
+	client := NewClient(context.Background(), addr, pc.DialOptions...)
+	client.tracer = pc.Tracer
+	client.compression = pc.Compression
+	return client
+}
+
+// Compression configures the compression of values sent between peers. The
+// format is negotiated per request: clients list the compressors they accept,
+// and servers compress with the first of their own compressors that the
+// client accepts. Peers without a common compressor send values raw.
+type Compression struct {
+	// Compressors are the supported compressors, in order of preference.
+	Compressors []distcache.Compressor
+	// MinSize is the size in bytes below which values are sent raw.
+	MinSize int
+}
+
+func (c Compression) names() []string {
+	if len(c.Compressors) == 0 {
+		return nil
+	}
+	names := make([]string, len(c.Compressors))
+	for i, comp := range c.Compressors {
+		names[i] = comp.Name()
+	}
+	return names
+}
+
+func (c Compression) lookup(name string) distcache.Compressor {
+	for _, comp := range c.Compressors {
+		if comp.Name() == name {
+			return comp
+		}
+	}
+	return nil
+}
+
+// negotiate returns the preferred compressor that is also accepted, or nil.
+func (c Compression) negotiate(accepted []string) distcache.Compressor {
+	for _, comp := range c.Compressors {
+		if slices.Contains(accepted, comp.Name()) {
+			return comp
+		}
+	}
+	return nil
+}
+
+// encode compresses val with comp, returning the value and its encoding.
+func (c Compression) encode(comp distcache.Compressor, val []byte) ([]byte, string, error) {
+	if comp == nil {
+		return val, "", nil
+	}
+	out, compressed, err := distcache.Compress(comp, val, c.MinSize)
+	if err != nil || !compressed {
+		return val, "", err
+	}
+	return out, comp.Name(), nil
+}
+
+// decode decompresses a value received with the provided encoding.
+func (c Compression) decode(val []byte, encoding string) ([]byte, error) {
+	if encoding == "" {
+		return val, nil
+	}
+	comp := c.lookup(encoding)
+	if comp == nil {
+		return nil, fmt.Errorf("unsupported value encoding: %q", encoding)
+	}
+	return comp.Decompress(val)
 }
 
 const maxRequestCount = 10
@@ -54,3 +131,78 @@ func getRequestCount(ctx context.Context) int {
 func withRequestCount(ctx context.Context, count int) context.Context {
 	return context.WithValue(ctx, requestCountKey, count)
 }
+
+// durationToMillis converts a TTL to milliseconds, rounding up so that a short
+// but non-zero TTL is never sent as zero (which means no expiry).
+func durationToMillis(d time.Duration) int64 {
+	if d <= 0 {
+		return 0
+	}
+	return int64((d + time.Millisecond - 1) / time.Millisecond)
+}
+
+func millisToDuration(ms int64) time.Duration {
+	if ms <= 0 {
+		return 0
+	}
+	return time.Duration(ms) * time.Millisecond
+}
+
+// injectTrace adds the trace context in ctx to the outgoing gRPC metadata.
+func injectTrace(ctx context.Context, tracer distcache.Tracer) context.Context {
+	if tracer == nil {
+		return ctx
+	}
+	carrier := make(map[string]string)
+	tracer.Inject(ctx, carrier)
+	if len(carrier) == 0 {
+		return ctx
+	}
+	kv := make([]string, 0, 2*len(carrier))
+	for k, v := range carrier {
+		kv = append(kv, k, v)
+	}
+	return metadata.AppendToOutgoingContext(ctx, kv...)
+}
+
+// extractTrace returns ctx with the trace context from the incoming gRPC
+// metadata.
+func extractTrace(ctx context.Context, tracer distcache.Tracer) context.Context {
+	if tracer == nil {
+		return ctx
+	}
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return ctx
+	}
+	carrier := make(map[string]string, len(md))
+	for k, vs := range md {
+		if len(vs) > 0 {
+			carrier[k] = vs[0]
+		}
+	}
+	return tracer.Extract(ctx, carrier)
+}
+
+func toEntries(entries map[string]distcache.Entry) []*pb.Entry {
+	out := make([]*pb.Entry, 0, len(entries))
+	for key, entry := range entries {
+		out = append(out, &pb.Entry{
+			Key:   key,
+			Value: entry.Value,
+			TtlMs: durationToMillis(entry.TTL),
+		})
+	}
+	return out
+}
+
+func fromEntries(entries []*pb.Entry) map[string]distcache.Entry {
+	out := make(map[string]distcache.Entry, len(entries))
+	for _, entry := range entries {
+		out[entry.GetKey()] = distcache.Entry{
+			Value: entry.GetValue(),
+			TTL:   millisToDuration(entry.GetTtlMs()),
+		}
+	}
+	return out
+}
@@ -2,6 +2,8 @@ package grpc
 
 import (
 	"bytes"
+	"compress/flate"
+	"compress/gzip"
 	"context"
 	"errors"
 	"fmt"
@@ -20,16 +22,18 @@ import (
 func TestGRPC(t *testing.T) {
 	table := []struct {
 		name            string
-		getFn           func(context.Context, string) ([]byte, distcache.ResultSource, error)
+		getFn           func(context.Context, string) (distcache.Result, error)
 		key             string
 		expBytes        []byte
 		expResultSource distcache.ResultSource
+		expTTL          time.Duration
 		expErr          bool
+		expErrIs        error
 	}{
 		{
 			name: "should return successfully from cache",
-			getFn: func(ctx context.Context, key string) ([]byte, distcache.ResultSource, error) {
-				return []byte(key), distcache.ResultHotCache, nil
+			getFn: func(ctx context.Context, key string) (distcache.Result, error) {
+				return distcache.Result{Value: []byte(key), Source: distcache.ResultHotCache}, nil
 			},
 			key:             "keyboard cat",
 			expBytes:        []byte("keyboard cat"),
@@ -38,18 +42,38 @@ func TestGRPC(t *testing.T) {
 		},
 		{
 			name: "should return successfully from peer",
-			getFn: func(ctx context.Context, key string) ([]byte, distcache.ResultSource, error) {
-				return []byte(key), distcache.ResultLocalGet, nil
+			getFn: func(ctx context.Context, key string) (distcache.Result, error) {
+				return distcache.Result{Value: []byte(key), Source: distcache.ResultLocalGet}, nil
 			},
 			key:             "keyboard cat",
 			expBytes:        []byte("keyboard cat"),
 			expResultSource: distcache.ResultPeerGet,
 			expErr:          false,
 		},
+		{
+			name: "should return the remaining ttl",
+			getFn: func(ctx context.Context, key string) (distcache.Result, error) {
+				return distcache.Result{Value: []byte(key), Source: distcache.ResultLocalCache, TTL: 1500 * time.Microsecond}, nil
+			},
+			key:             "keyboard cat",
+			expBytes:        []byte("keyboard cat"),
+			expResultSource: distcache.ResultPeerCache,
+			expTTL:          2 * time.Millisecond,
+			expErr:          false,
+		},
+		{
+			name: "should return not found",
+			getFn: func(ctx context.Context, key string) (distcache.Result, error) {
+				return distcache.Result{}, distcache.ErrNotFound
+			},
+			key:      "keyboard cat",
+			expErr:   true,
+			expErrIs: distcache.ErrNotFound,
+		},
 		{
 			name: "should return an error",
-			getFn: func(ctx context.Context, key string) ([]byte, distcache.ResultSource, error) {
-				return nil, distcache.ResultNone, errors.New("failed")
+			getFn: func(ctx context.Context, key string) (distcache.Result, error) {
+				return distcache.Result{}, errors.New("failed")
 			},
 			key:    "keyboard cat",
 			expErr: true,
@@ -83,21 +107,27 @@ func TestGRPC(t *testing.T) {
 			client := NewClient(ctx, lis.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
 			defer client.Close()
 
-			out, res, err := client.Get(ctx, test.key)
+			res, err := client.Get(ctx, test.key)
 			if err != nil {
 				if !test.expErr {
 					t.Fatalf("unexpected error from Get: %s", err.Error())
 				}
+				if test.expErrIs != nil && !errors.Is(err, test.expErrIs) {
+					t.Fatalf("unexpected error from Get: %s", err.Error())
+				}
 				return
 			}
 			if test.expErr {
 				t.Fatal("unexpected success from Get")
 			}
-			if !bytes.Equal(test.expBytes, out) {
-				t.Fatalf("unexpected bytes returned: %s", out)
+			if !bytes.Equal(test.expBytes, res.Value) {
+				t.Fatalf("unexpected bytes returned: %s", res.Value)
+			}
+			if test.expResultSource != res.Source {
+				t.Fatalf("unexpected result source: %s", res.Source.String())
 			}
-			if test.expResultSource != res {
-				t.Fatalf("unexpected result source: %s", res.String())
+			if test.expTTL != res.TTL {
+				t.Fatalf("unexpected ttl: %s", res.TTL)
 			}
 		})
 	}
@@ -116,7 +146,7 @@ func TestGRPCLoop(t *testing.T) {
 	defer client.Close()
 
 	server := Server{Cache: &mockCache{
-		getFn: func(ctx context.Context, key string) ([]byte, distcache.ResultSource, error) {
+		getFn: func(ctx context.Context, key string) (distcache.Result, error) {
 			return client.Get(ctx, key)
 		},
 	}}
@@ -128,7 +158,7 @@ func TestGRPCLoop(t *testing.T) {
 	}()
 
 	err := retry(ctx, func(ctx context.Context) (bool, error) {
-		_, _, err := client.Get(ctx, "keyboard cat")
+		_, err := client.Get(ctx, "keyboard cat")
 		if err == nil {
 			return false, errors.New("error expected")
 		}
@@ -142,6 +172,308 @@ func TestGRPCLoop(t *testing.T) {
 	}
 }
 
+func TestGRPCGetMulti(t *testing.T) {
+	addr := getFreeAddr(t)
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	server := Server{Cache: &mockCache{
+		getFn: func(ctx context.Context, key string) (distcache.Result, error) {
+			if key == "fail" {
+				return distcache.Result{}, errors.New("failed")
+			}
+			return distcache.Result{Value: []byte(key), Source: distcache.ResultHotCache, TTL: time.Second}, nil
+		},
+	}}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		_ = server.Listen(ctx, addr)
+	}()
+
+	client := NewClient(ctx, addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	defer client.Close()
+
+	var results map[string]distcache.Result
+	err := retry(ctx, func(ctx context.Context) (bool, error) {
+		var err error
+		results, err = client.GetMulti(ctx, []string{"keyboard", "cat", "fail"})
+		var keyErrs distcache.KeyErrors
+		if !errors.As(err, &keyErrs) {
+			return false, fmt.Errorf("unexpected error: %v", err)
+		}
+		if len(keyErrs) != 1 || keyErrs["fail"] == nil {
+			return true, fmt.Errorf("unexpected key errors: %v", keyErrs)
+		}
+		return true, nil
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(results) != 2 {
+		t.Fatalf("unexpected number of results: %d", len(results))
+	}
+	for _, key := range []string{"keyboard", "cat"} {
+		res := results[key]
+		if string(res.Value) != key || res.Source != distcache.ResultPeerCache || res.TTL != time.Second {
+			t.Fatalf("unexpected result for key %q: %+v", key, res)
+		}
+	}
+}
+
+func TestGRPCTracePropagation(t *testing.T) {
+	addr := getFreeAddr(t)
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	tracer := traceIDTracer{}
+	server := Server{
+		Cache: &mockCache{
+			getFn: func(ctx context.Context, key string) (distcache.Result, error) {
+				id, _ := ctx.Value(traceIDKey{}).(string)
+				return distcache.Result{Value: []byte(id)}, nil
+			},
+		},
+		Tracer: tracer,
+	}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		_ = server.Listen(ctx, addr)
+	}()
+
+	pc := PeerCreator{
+		DialOptions: []grpc.DialOption{grpc.WithTransportCredentials(insecure.NewCredentials())},
+		Tracer:      tracer,
+	}
+	client := pc.NewPeer(addr)
+	defer client.Close()
+
+	var res distcache.Result
+	err := retry(ctx, func(ctx context.Context) (bool, error) {
+		var err error
+		res, err = client.Get(context.WithValue(ctx, traceIDKey{}, "trace-123"), "keyboard cat")
+		return err == nil, err
+	})
+	if err != nil {
+		t.Fatalf("unexpected error from Get: %s", err.Error())
+	}
+	if string(res.Value) != "trace-123" {
+		t.Fatalf("unexpected trace id received by server: %q", res.Value)
+	}
+}
+
+type traceIDKey struct{}
+
+// traceIDTracer propagates a trace ID stored in the context, without creating
+// any spans.
+type traceIDTracer struct{}
+
+func (traceIDTracer) Start(ctx context.Context, name string) (context.Context, distcache.Span) {
+	return ctx, nil
+}
+
+func (traceIDTracer) Inject(ctx context.Context, carrier map[string]string) {
+	if id, ok := ctx.Value(traceIDKey{}).(string); ok {
+		carrier["x-trace-id"] = id
+	}
+}
+
+func (traceIDTracer) Extract(ctx context.Context, carrier map[string]string) context.Context {
+	if id, ok := carrier["x-trace-id"]; ok {
+		return context.WithValue(ctx, traceIDKey{}, id)
+	}
+	return ctx
+}
+
+func TestGRPCDelete(t *testing.T) {
+	addr := getFreeAddr(t)
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	deleted := make(chan string, 1)
+	server := Server{Cache: &mockCache{
+		deleteFn: func(ctx context.Context, key string) error {
+			deleted <- key
+			return nil
+		},
+	}}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		_ = server.Listen(ctx, addr)
+	}()
+
+	client := NewClient(ctx, addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	defer client.Close()
+
+	err := retry(ctx, func(ctx context.Context) (bool, error) {
+		err := client.Delete(ctx, "keyboard cat")
+		return err == nil, err
+	})
+	if err != nil {
+		t.Fatalf("unexpected error from Delete: %s", err.Error())
+	}
+	if key := <-deleted; key != "keyboard cat" {
+		t.Fatalf("unexpected key deleted: %s", key)
+	}
+}
+
+func TestGRPCHandoff(t *testing.T) {
+	addr := getFreeAddr(t)
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	received := make(chan map[string]distcache.Entry, 1)
+	server := Server{Cache: &mockCache{
+		handoffFn: func(ctx context.Context, entries map[string]distcache.Entry) error {
+			received <- entries
+			return nil
+		},
+	}}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		_ = server.Listen(ctx, addr)
+	}()
+
+	client := NewClient(ctx, addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	defer client.Close()
+
+	err := retry(ctx, func(ctx context.Context) (bool, error) {
+		err := client.Handoff(ctx, map[string]distcache.Entry{
+			"key1": {Value: []byte("val1"), TTL: time.Minute},
+			"key2": {Value: []byte("val2")},
+		})
+		return err == nil, err
+	})
+	if err != nil {
+		t.Fatalf("unexpected error from Handoff: %s", err.Error())
+	}
+	entries := <-received
+	if len(entries) != 2 {
+		t.Fatalf("unexpected entries: %v", entries)
+	}
+	if e := entries["key1"]; string(e.Value) != "val1" || e.TTL != time.Minute {
+		t.Fatalf("unexpected entry: %+v", e)
+	}
+	if e := entries["key2"]; string(e.Value) != "val2" || e.TTL != 0 {
+		t.Fatalf("unexpected entry: %+v", e)
+	}
+}
+
+func TestGRPCCompression(t *testing.T) {
+	addr := getFreeAddr(t)
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	large := bytes.Repeat([]byte("compressible "), 100)
+	server := Server{
+		Cache: &mockCache{
+			getFn: func(ctx context.Context, key string) (distcache.Result, error) {
+				if key == "small" {
+					return distcache.Result{Value: []byte("small")}, nil
+				}
+				return distcache.Result{Value: large}, nil
+			},
+		},
+		Compression: Compression{
+			Compressors: []distcache.Compressor{distcache.Gzip(gzip.DefaultCompression), distcache.Flate(flate.BestSpeed)},
+			MinSize:     64,
+		},
+	}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		_ = server.Listen(ctx, addr)
+	}()
+
+	pc := &PeerCreator{
+		DialOptions: []grpc.DialOption{grpc.WithTransportCredentials(insecure.NewCredentials())},
+		Compression: Compression{Compressors: []distcache.Compressor{distcache.Flate(flate.BestSpeed)}},
+	}
+	client := pc.NewPeer(addr).(*Client)
+	defer client.Close()
+	raw := NewClient(ctx, addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	defer raw.Close()
+
+	err := retry(ctx, func(ctx context.Context) (bool, error) {
+		_, err := client.Get(ctx, "large")
+		return err == nil, err
+	})
+	if err != nil {
+		t.Fatalf("unexpected error from Get: %s", err.Error())
+	}
+
+	// The server compresses with its preferred compressor that the client
+	// accepts, and only above the minimum size.
+	for _, tc := range []struct {
+		client   *Client
+		key      string
+		encoding string
+	}{
+		{client, "large", "deflate"},
+		{client, "small", ""},
+		{raw, "large", ""},
+	} {
+		res, err := tc.client.client.Get(ctx, &pb.GetRequest{Key: tc.key, AcceptEncodings: tc.client.compression.names()})
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err.Error())
+		}
+		if res.Encoding != tc.encoding {
+			t.Fatalf("unexpected encoding for %q: %q", tc.key, res.Encoding)
+		}
+		if tc.encoding != "" && len(res.Value) >= len(large) {
+			t.Fatalf("value not compressed: %d bytes", len(res.Value))
+		}
+
+		got, err := tc.client.Get(ctx, tc.key)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err.Error())
+		}
+		want := large
+		if tc.key == "small" {
+			want = []byte("small")
+		}
+		if !bytes.Equal(got.Value, want) {
+			t.Fatalf("unexpected value for %q: %q", tc.key, got.Value)
+		}
+	}
+
+	results, err := client.GetMulti(ctx, []string{"large", "small"})
+	if err != nil {
+		t.Fatalf("unexpected error from GetMulti: %s", err.Error())
+	}
+	if !bytes.Equal(results["large"].Value, large) || string(results["small"].Value) != "small" {
+		t.Fatalf("unexpected results: %v", results)
+	}
+}
+
 func getFreeAddr(t *testing.T) string {
 	t.Helper()
 	lis, err := net.Listen("tcp", ":0")
@@ -153,10 +485,45 @@ func getFreeAddr(t *testing.T) string {
 }
 
 type mockCache struct {
-	getFn func(context.Context, string) ([]byte, distcache.ResultSource, error)
+	getFn     func(context.Context, string) (distcache.Result, error)
+	deleteFn  func(context.Context, string) error
+	handoffFn func(context.Context, map[string]distcache.Entry) error
+	replicaFn func(context.Context, map[string]distcache.Entry) error
+}
+
+func (c *mockCache) GetMulti(ctx context.Context, keys []string) (map[string]distcache.Result, error) {
+	results := make(map[string]distcache.Result, len(keys))
+	var errs distcache.KeyErrors
+	for _, key := range keys {
+		res, err := c.getFn(ctx, key)
+		if err != nil {
+			if errs == nil {
+				errs = make(distcache.KeyErrors)
+			}
+			errs[key] = err
+			continue
+		}
+		results[key] = res
+	}
+	if errs != nil {
+		return results, errs
+	}
+	return results, nil
+}
+
+func (c *mockCache) Delete(ctx context.Context, key string) error {
+	return c.deleteFn(ctx, key)
+}
+
+func (c *mockCache) Handoff(ctx context.Context, entries map[string]distcache.Entry) error {
+	return c.handoffFn(ctx, entries)
+}
+
+func (c *mockCache) Replicate(ctx context.Context, entries map[string]distcache.Entry) error {
+	return c.replicaFn(ctx, entries)
 }
 
-func (c *mockCache) Get(ctx context.Context, key string) ([]byte, distcache.ResultSource, error) {
+func (c *mockCache) GetResult(ctx context.Context, key string) (distcache.Result, error) {
 	return c.getFn(ctx, key)
 }
 
@@ -24,6 +24,7 @@ package grpc
 
 import (
 	"context"
+	"errors"
 	"net"
 
 	"github.com/ryanfowler/distcache"
@@ -36,22 +37,111 @@ import (
 var _ (pb.PeerServiceServer) = (*Server)(nil)
 
 type Cache interface {
-	Get(ctx context.Context, key string) ([]byte, distcache.ResultSource, error)
+	GetResult(ctx context.Context, key string) (distcache.Result, error)
+	GetMulti(ctx context.Context, keys []string) (map[string]distcache.Result, error)
+	Delete(ctx context.Context, key string) error
+	Handoff(ctx context.Context, entries map[string]distcache.Entry) error
+	Replicate(ctx context.Context, entries map[string]distcache.Entry) error
 }
 
 type Server struct {
 	Cache Cache
+	// Tracer, if set, is used to continue traces propagated by peers.
+	Tracer distcache.Tracer
+	// Compression configures the compression of values returned to clients
+	// that accept it.
+	Compression Compression
 	pb.UnimplementedPeerServiceServer
 }
 
 func (s *Server) Get(ctx context.Context, req *pb.GetRequest) (*pb.GetResponse, error) {
+	ctx = extractTrace(ctx, s.Tracer)
 	ctx = withRequestCount(ctx, int(req.GetPeerRequestCount()))
-	val, res, err := s.Cache.Get(ctx, req.GetKey())
+	res, err := s.Cache.GetResult(ctx, req.GetKey())
 	if err != nil {
+		return nil, toStatus(err)
+	}
+	comp := s.Compression.negotiate(req.GetAcceptEncodings())
+	val, encoding, err := s.Compression.encode(comp, res.Value)
+	if err != nil {
+		return nil, toStatus(err)
+	}
+	return &pb.GetResponse{
+		Value:    val,
+		CacheHit: isCacheHit(res.Source),
+		TtlMs:    durationToMillis(res.TTL),
+		Encoding: encoding,
+	}, nil
+}
+
+func (s *Server) GetMulti(ctx context.Context, req *pb.GetMultiRequest) (*pb.GetMultiResponse, error) {
+	ctx = extractTrace(ctx, s.Tracer)
+	ctx = withRequestCount(ctx, int(req.GetPeerRequestCount()))
+	results, err := s.Cache.GetMulti(ctx, req.GetKeys())
+	var keyErrs distcache.KeyErrors
+	if err != nil && !errors.As(err, &keyErrs) {
+		return nil, toStatus(err)
+	}
+
+	comp := s.Compression.negotiate(req.GetAcceptEncodings())
+	out := make([]*pb.GetMultiResult, 0, len(results)+len(keyErrs))
+	for key, res := range results {
+		val, encoding, err := s.Compression.encode(comp, res.Value)
+		if err != nil {
+			out = append(out, &pb.GetMultiResult{Key: key, Error: err.Error()})
+			continue
+		}
+		out = append(out, &pb.GetMultiResult{
+			Key:      key,
+			Value:    val,
+			CacheHit: isCacheHit(res.Source),
+			TtlMs:    durationToMillis(res.TTL),
+			Encoding: encoding,
+		})
+	}
+	for key, err := range keyErrs {
+		if errors.Is(err, distcache.ErrNotFound) {
+			out = append(out, &pb.GetMultiResult{Key: key, NotFound: true})
+			continue
+		}
+		out = append(out, &pb.GetMultiResult{Key: key, Error: err.Error()})
+	}
+	return &pb.GetMultiResponse{Results: out}, nil
+}
+
+func toStatus(err error) error {
+	if errors.Is(err, distcache.ErrNotFound) {
+		return status.Error(codes.NotFound, err.Error())
+	}
+	return status.Error(codes.Internal, err.Error())
+}
+
+func isCacheHit(src distcache.ResultSource) bool {
+	return src == distcache.ResultHotCache || src == distcache.ResultLocalCache || src == distcache.ResultStale
+}
+
+func (s *Server) Delete(ctx context.Context, req *pb.DeleteRequest) (*pb.DeleteResponse, error) {
+	ctx = extractTrace(ctx, s.Tracer)
+	if err := s.Cache.Delete(ctx, req.GetKey()); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	return &pb.DeleteResponse{}, nil
+}
+
+func (s *Server) Handoff(ctx context.Context, req *pb.HandoffRequest) (*pb.HandoffResponse, error) {
+	ctx = extractTrace(ctx, s.Tracer)
+	if err := s.Cache.Handoff(ctx, fromEntries(req.GetEntries())); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	return &pb.HandoffResponse{}, nil
+}
+
+func (s *Server) Replicate(ctx context.Context, req *pb.ReplicateRequest) (*pb.ReplicateResponse, error) {
+	ctx = extractTrace(ctx, s.Tracer)
+	if err := s.Cache.Replicate(ctx, fromEntries(req.GetEntries())); err != nil {
 		return nil, status.Error(codes.Internal, err.Error())
 	}
-	cacheHit := res == distcache.ResultHotCache || res == distcache.ResultLocalCache
-	return &pb.GetResponse{Value: val, CacheHit: cacheHit}, nil
+	return &pb.ReplicateResponse{}, nil
 }
 
 func (s *Server) Listen(ctx context.Context, addr string, opt ...grpc.ServerOption) error {
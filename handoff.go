@@ -0,0 +1,178 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2020 Ryan Fowler
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package distcache
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"time"
+)
+
+// handoffBatchBytes is the maximum size of the entries sent in a single
+// handoff request.
+const handoffBatchBytes = 256 << 10
+
+// HandoffPeer is a Peer that can receive entries from other nodes when the
+// ownership of keys changes.
+type HandoffPeer interface {
+	Peer
+	Handoff(ctx context.Context, entries map[string]Entry) error
+}
+
+// Ranger is a Store that can iterate over its entries, stopping when fn
+// returns false.
+type Ranger interface {
+	Range(fn func(key string, val []byte) bool)
+}
+
+// Handoff stores entries handed off by a peer after the ownership of keys
+// changed. Entries for keys that this node doesn't own, or already has in its
+// local store, are ignored.
+func (c *Cache) Handoff(ctx context.Context, entries map[string]Entry) error {
+	c.mu.Lock()
+	picker := c.picker
+	c.mu.Unlock()
+
+	var errs []error
+	for key, entry := range entries {
+		if isNotFoundKey(key) || picker.PickPeer(key) != c.me {
+			continue
+		}
+		if val, _, err := c.localStore.Get(ctx, key); err == nil && val != nil {
+			continue
+		}
+		if err := c.storeSet(ctx, StoreLocal, key, entry.Value, entry.TTL); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// startHandoff cancels any running handoff, and starts sending the entries in
+// the local store that this node no longer owns, or holds a replica of, to
+// their new primary owners.
+func (c *Cache) startHandoff(picker PeerPicker, peers peerMap) {
+	if c.cancelHandoff != nil {
+		c.cancelHandoff()
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	c.cancelHandoff = cancel
+	go func() {
+		defer cancel()
+		c.handoff(ctx, picker, peers)
+	}()
+}
+
+func (c *Cache) handoff(ctx context.Context, picker PeerPicker, peers peerMap) {
+	ranger, ok := c.localStore.(Ranger)
+	if !ok {
+		return
+	}
+
+	// Collect the keys first, so that the store isn't locked while sending.
+	// Stores range from the most recently used entry, so the budget is spent
+	// on the hottest keys.
+	budget := c.handoffBytes
+	byOwner := make(map[string][]string)
+	ranger.Range(func(key string, val []byte) bool {
+		if isNotFoundKey(key) {
+			return true
+		}
+		owners := c.owners(picker, key)
+		if len(owners) == 0 || slices.Contains(owners, c.me) {
+			return true
+		}
+		owner := owners[0]
+		peer, ok := peers[owner]
+		if !ok {
+			return true
+		}
+		if _, ok := peer.Peer.(HandoffPeer); !ok {
+			return true
+		}
+		budget -= len(key) + len(val)
+		if budget < 0 {
+			return false
+		}
+		byOwner[owner] = append(byOwner[owner], key)
+		return true
+	})
+
+	for addr, keys := range byOwner {
+		for len(keys) > 0 {
+			peer, ok := peers.acquire(addr)
+			if !ok {
+				// The peer has since been removed.
+				break
+			}
+			var n int
+			keys, n = c.handoffBatch(ctx, addr, peer.Peer.(HandoffPeer), keys)
+			peer.release()
+			if !c.waitHandoffRate(ctx, n) {
+				return
+			}
+		}
+	}
+}
+
+// handoffBatch sends the next batch of keys to peer, returning the remaining
+// keys and the number of bytes sent.
+func (c *Cache) handoffBatch(ctx context.Context, addr string, peer HandoffPeer, keys []string) ([]string, int) {
+	entries := make(map[string]Entry)
+	var size int
+	for len(keys) > 0 && size < handoffBatchBytes {
+		key := keys[0]
+		keys = keys[1:]
+		// Get the value again for its TTL, skipping it if it has since
+		// been removed.
+		val, ttl, err := c.localStore.Get(ctx, key)
+		if err != nil || val == nil {
+			continue
+		}
+		entries[key] = Entry{Value: val, TTL: ttl}
+		size += len(key) + len(val)
+	}
+	if len(entries) == 0 {
+		return keys, 0
+	}
+	err := peer.Handoff(ctx, entries)
+	c.observe(ctx, HandoffEvent{Peer: addr, Keys: len(entries), Bytes: size, Err: err})
+	return keys, size
+}
+
+// waitHandoffRate waits long enough after sending n bytes to stay within the
+// handoff rate, returning false if ctx is done.
+func (c *Cache) waitHandoffRate(ctx context.Context, n int) bool {
+	if c.handoffRate <= 0 || n == 0 {
+		return ctx.Err() == nil
+	}
+	timer := time.NewTimer(time.Duration(float64(n) / float64(c.handoffRate) * float64(time.Second)))
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
@@ -0,0 +1,309 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2020 Ryan Fowler
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package distcache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+	"sync"
+	"time"
+)
+
+// errPeerEjected is reported when a peer is skipped because it's ejected.
+var errPeerEjected = errors.New("peer ejected")
+
+// healthWindow is the number of recent requests to each peer used to compute
+// its error rate and latency.
+const healthWindow = 64
+
+// Ejection configures when peers are temporarily removed from routing, so that
+// their keys are retrieved from the next owner or the local Getter instead of
+// waiting on an unhealthy peer. The zero value disables ejection.
+type Ejection struct {
+	// ConsecutiveFailures, if non-zero, ejects a peer after this many
+	// failed requests in a row.
+	ConsecutiveFailures int
+	// ErrorRate, if non-zero, ejects a peer once this fraction of its recent
+	// requests have failed.
+	ErrorRate float64
+	// LatencyP99, if non-zero, ejects a peer once the 99th percentile
+	// latency of its recent requests exceeds it.
+	LatencyP99 time.Duration
+	// MinRequests is the number of recent requests needed before ErrorRate
+	// and LatencyP99 apply. Defaults to 20.
+	MinRequests int
+	// Duration is how long a peer is ejected for before a single probe
+	// request is allowed through to test whether it has recovered. Defaults
+	// to 10 seconds.
+	Duration time.Duration
+}
+
+func (e Ejection) enabled() bool {
+	return e.ConsecutiveFailures > 0 || e.ErrorRate > 0 || e.LatencyP99 > 0
+}
+
+// PeerState is the health of a peer, as used for routing.
+type PeerState int
+
+const (
+	// PeerHealthy peers are sent requests as normal.
+	PeerHealthy PeerState = iota
+	// PeerEjected peers are skipped until their ejection expires.
+	PeerEjected
+	// PeerProbing peers have been sent a single request to test whether they
+	// have recovered.
+	PeerProbing
+)
+
+func (ps PeerState) String() string {
+	switch ps {
+	case PeerHealthy:
+		return "healthy"
+	case PeerEjected:
+		return "ejected"
+	case PeerProbing:
+		return "probing"
+	default:
+		return "unknown"
+	}
+}
+
+type healthSample struct {
+	failed  bool
+	latency time.Duration
+}
+
+// peerHealth tracks the recent requests to a peer to decide whether it
+// should be sent requests, and how long they're expected to take.
+type peerHealth struct {
+	policy Ejection
+	now    func() time.Time
+
+	mu          sync.Mutex
+	state       PeerState
+	until       time.Time
+	consecutive int
+	samples     [healthWindow]healthSample
+	next        int
+	count       int
+}
+
+func newPeerHealth(policy Ejection) *peerHealth {
+	if policy.MinRequests <= 0 {
+		policy.MinRequests = 20
+	}
+	if policy.Duration <= 0 {
+		policy.Duration = 10 * time.Second
+	}
+	return &peerHealth{policy: policy, now: time.Now}
+}
+
+// allow returns whether a request can be sent to the peer, along with the new
+// state if it changed. Once an ejection expires, a single probe request is
+// allowed.
+func (h *peerHealth) allow() (bool, PeerState, bool) {
+	if !h.policy.enabled() {
+		return true, PeerHealthy, false
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	switch h.state {
+	case PeerEjected:
+		if h.now().Before(h.until) {
+			return false, h.state, false
+		}
+		h.state = PeerProbing
+		return true, h.state, true
+	case PeerProbing:
+		return false, h.state, false
+	default:
+		return true, h.state, false
+	}
+}
+
+// record records the outcome of a request allowed by allow, returning the new
+// state and why it changed, if it did.
+func (h *peerHealth) record(latency time.Duration, err error) (PeerState, string, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	failed := err != nil
+
+	if h.state == PeerProbing {
+		if failed {
+			h.eject()
+			return h.state, "probe failed", true
+		}
+		h.reset()
+		return h.state, "probe succeeded", true
+	}
+	if h.state != PeerHealthy {
+		return h.state, "", false
+	}
+	return h.sample(latency, failed)
+}
+
+// sample adds a request to the recent samples of a healthy peer, ejecting it
+// if they're now unhealthy.
+func (h *peerHealth) sample(latency time.Duration, failed bool) (PeerState, string, bool) {
+	h.samples[h.next] = healthSample{failed: failed, latency: latency}
+	h.next = (h.next + 1) % healthWindow
+	h.count = min(h.count+1, healthWindow)
+	if failed {
+		h.consecutive++
+	} else {
+		h.consecutive = 0
+	}
+
+	reason := h.ejectReason()
+	if reason == "" {
+		return h.state, "", false
+	}
+	h.eject()
+	return h.state, reason, true
+}
+
+// recordSlow records that a request took at least latency before it was
+// cancelled, as a successful sample for the latency percentiles. Like abandon,
+// it releases a probe without ending it.
+func (h *peerHealth) recordSlow(latency time.Duration) (PeerState, string, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.state == PeerProbing {
+		h.state = PeerEjected
+		return h.state, "", false
+	}
+	if h.state != PeerHealthy {
+		return h.state, "", false
+	}
+	return h.sample(latency, false)
+}
+
+// abandon releases a probe without recording its outcome, such as when the
+// caller gave up on the request.
+func (h *peerHealth) abandon() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.state == PeerProbing {
+		h.state = PeerEjected
+	}
+}
+
+func (h *peerHealth) ejectReason() string {
+	p := h.policy
+	if p.ConsecutiveFailures > 0 && h.consecutive >= p.ConsecutiveFailures {
+		return fmt.Sprintf("%d consecutive failures", h.consecutive)
+	}
+	if h.count < p.MinRequests {
+		return ""
+	}
+	samples := h.samples[:h.count]
+	if p.ErrorRate > 0 {
+		var failures int
+		for _, s := range samples {
+			if s.failed {
+				failures++
+			}
+		}
+		if rate := float64(failures) / float64(len(samples)); rate >= p.ErrorRate {
+			return fmt.Sprintf("error rate %.2f", rate)
+		}
+	}
+	if p.LatencyP99 > 0 {
+		if p99 := h.quantile(0.99); p99 > p.LatencyP99 {
+			return fmt.Sprintf("p99 latency %s", p99)
+		}
+	}
+	return ""
+}
+
+// latency returns the q quantile of the latency of recent requests, if there
+// have been enough of them.
+func (h *peerHealth) latency(q float64) (time.Duration, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.count < h.policy.MinRequests {
+		return 0, false
+	}
+	return h.quantile(q), true
+}
+
+func (h *peerHealth) quantile(q float64) time.Duration {
+	latencies := make([]time.Duration, h.count)
+	for i, s := range h.samples[:h.count] {
+		latencies[i] = s.latency
+	}
+	slices.Sort(latencies)
+	idx := int(math.Ceil(q*float64(len(latencies)))) - 1
+	return latencies[max(0, min(idx, len(latencies)-1))]
+}
+
+func (h *peerHealth) eject() {
+	h.state = PeerEjected
+	h.until = h.now().Add(h.policy.Duration)
+}
+
+func (h *peerHealth) reset() {
+	h.state = PeerHealthy
+	h.consecutive = 0
+	h.next = 0
+	h.count = 0
+}
+
+// allowPeer returns whether a request for keys can be sent to peer, based on
+// its health.
+func (c *Cache) allowPeer(ctx context.Context, addr string, peer *peerHandle) bool {
+	ok, state, changed := peer.health.allow()
+	if changed {
+		c.observe(ctx, PeerHealthEvent{Peer: addr, State: state, Reason: "ejection expired"})
+	}
+	return ok
+}
+
+// recordPeer records the outcome of a request to peer allowed by allowPeer.
+func (c *Cache) recordPeer(ctx context.Context, addr string, peer *peerHandle, latency time.Duration, err error) {
+	if errors.Is(err, ErrNotFound) {
+		err = nil
+	}
+	var state PeerState
+	var reason string
+	var changed bool
+	switch {
+	case err != nil && errors.Is(context.Cause(ctx), errHedged):
+		// A hedged request answered first, so the peer was at least this
+		// slow. Dropping these would skew its latency low.
+		state, reason, changed = peer.health.recordSlow(latency)
+	case err != nil && ctx.Err() != nil:
+		// The request failed because the caller gave up, which says nothing
+		// about the peer.
+		peer.health.abandon()
+		return
+	default:
+		state, reason, changed = peer.health.record(latency, err)
+	}
+	if changed {
+		c.observe(ctx, PeerHealthEvent{Peer: addr, State: state, Reason: reason})
+	}
+}
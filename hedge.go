@@ -0,0 +1,179 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2020 Ryan Fowler
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package distcache
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// hedgeBudgetTokens is the most hedged requests that can be saved up in the
+// hedging budget.
+const hedgeBudgetTokens = 10
+
+// errHedged is the cause of cancelling a request to a peer when its hedged
+// request answered first.
+var errHedged = errors.New("distcache: hedged request answered first")
+
+// Hedging configures hedged requests. When the owner of a key hasn't answered
+// within a delay based on its recent latency, the key is also requested from
+// its next owner, or the local Getter, and whichever returns first is used.
+// The zero value disables hedging.
+type Hedging struct {
+	// Percentile is the quantile, in (0, 1], of the owner's recent latency
+	// to wait before hedging, such as 0.95.
+	Percentile float64
+	// MinDelay is the minimum time to wait before hedging. It's also used
+	// until enough requests have been sent to the owner to measure its
+	// latency.
+	MinDelay time.Duration
+	// Budget limits hedged requests to this ratio of requests to peers, such
+	// that hedging can increase load by at most 1+Budget times. The budget
+	// starts empty, and up to 10 unused hedges are saved up, which can then
+	// be sent in a burst. Defaults to 0.1.
+	Budget float64
+}
+
+// hedgeBudget is a token bucket that's filled by requests to peers, and
+// drained by hedged requests.
+type hedgeBudget struct {
+	mu     sync.Mutex
+	ratio  float64
+	tokens float64
+}
+
+func newHedgeBudget(ratio float64) *hedgeBudget {
+	if ratio <= 0 {
+		ratio = 0.1
+	}
+	return &hedgeBudget{ratio: ratio}
+}
+
+func (b *hedgeBudget) deposit() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.tokens = min(b.tokens+b.ratio, hedgeBudgetTokens)
+}
+
+func (b *hedgeBudget) withdraw() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+type hedgeResult struct {
+	res    Result
+	err    error
+	hedged bool
+}
+
+// getFromPeerHedged gets key from peer, also calling alt if the peer hasn't
+// answered within the hedging delay, and returns whichever succeeds first.
+func (c *Cache) getFromPeerHedged(ctx context.Context, addr string, peer *peerHandle, key string, alt func(context.Context) (Result, error)) (Result, error) {
+	if c.hedging.Percentile <= 0 {
+		return c.getFromPeer(ctx, addr, peer, key)
+	}
+	c.hedgeBudget.deposit()
+
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	results := make(chan hedgeResult, 2)
+	go func() {
+		res, err := c.getFromPeer(ctx, addr, peer, key)
+		results <- hedgeResult{res: res, err: err}
+	}()
+
+	delay := c.hedging.MinDelay
+	if latency, ok := peer.health.latency(c.hedging.Percentile); ok {
+		delay = max(delay, latency)
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	pending := 1
+	select {
+	case r := <-results:
+		return r.res, r.err
+	case <-timer.C:
+		if c.hedgeBudget.withdraw() {
+			pending++
+			go func() {
+				res, err := alt(ctx)
+				results <- hedgeResult{res: res, err: err, hedged: true}
+			}()
+		}
+	}
+
+	var hedgeFailed bool
+	for {
+		r := <-results
+		if r.hedged {
+			if !isDefinitive(r.err) {
+				hedgeFailed = true
+				continue
+			}
+			// Stop the request to the peer, and wait for it so that the
+			// peer isn't released while it's still in use.
+			cancel(errHedged)
+			<-results
+			if r.err == nil {
+				r.res.Source = hedgedSource(r.res.Source)
+			}
+			return r.res, r.err
+		}
+		if isDefinitive(r.err) || pending == 1 || hedgeFailed {
+			return r.res, r.err
+		}
+		// The peer failed, so use the hedged request if it succeeds.
+		if h := <-results; isDefinitive(h.err) {
+			if h.err == nil {
+				h.res.Source = hedgedSource(h.res.Source)
+			}
+			return h.res, h.err
+		}
+		return r.res, r.err
+	}
+}
+
+// isDefinitive returns whether err is a definitive answer for a key.
+func isDefinitive(err error) bool {
+	return err == nil || errors.Is(err, ErrNotFound)
+}
+
+// hedgedSource returns the source reported for a result from a hedged request.
+func hedgedSource(src ResultSource) ResultSource {
+	switch src {
+	case ResultLocalGet:
+		return ResultHedgedLocalGet
+	case ResultPeerCache, ResultPeerGet:
+		return ResultHedgedPeer
+	default:
+		return src
+	}
+}
@@ -0,0 +1,114 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2020 Ryan Fowler
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+// Package sketch implements a count-min sketch for estimating how frequently
+// keys are accessed.
+package sketch
+
+import (
+	"hash/maphash"
+	"math/bits"
+)
+
+const depth = 4
+
+// MaxCount is the highest frequency that a CountMin estimates.
+const MaxCount = 15
+
+// CountMin estimates the frequency of keys using 4 rows of saturating
+// counters. All counts are halved once the number of increments reaches the
+// sample size, so that old accesses are gradually forgotten.
+//
+// CountMin is not safe for concurrent use.
+type CountMin struct {
+	seed    maphash.Seed
+	mask    uint64
+	rows    [depth][]uint8
+	samples int
+	adds    int
+}
+
+// New returns a CountMin sized for roughly size distinct keys.
+func New(size int) *CountMin {
+	if size < 1 {
+		size = 1
+	}
+	width := uint64(1) << bits.Len64(uint64(size-1))
+	cm := &CountMin{
+		seed:    maphash.MakeSeed(),
+		mask:    width - 1,
+		samples: 10 * size,
+	}
+	for i := range cm.rows {
+		cm.rows[i] = make([]uint8, width)
+	}
+	return cm
+}
+
+// Hash returns the hash of key used by the sketch.
+func (cm *CountMin) Hash(key string) uint64 {
+	return maphash.String(cm.seed, key)
+}
+
+// Add increments the count for the key with hash h.
+func (cm *CountMin) Add(h uint64) {
+	added := false
+	for i := range cm.rows {
+		idx := cm.index(h, i)
+		if cm.rows[i][idx] < MaxCount {
+			cm.rows[i][idx]++
+			added = true
+		}
+	}
+	if added {
+		cm.adds++
+		if cm.adds >= cm.samples {
+			cm.reset()
+		}
+	}
+}
+
+// Estimate returns the estimated count for the key with hash h.
+func (cm *CountMin) Estimate(h uint64) int {
+	min := uint8(MaxCount)
+	for i := range cm.rows {
+		if v := cm.rows[i][cm.index(h, i)]; v < min {
+			min = v
+		}
+	}
+	return int(min)
+}
+
+func (cm *CountMin) index(h uint64, row int) uint64 {
+	// Derive an index for each row using double hashing.
+	lo, hi := h&0xffffffff, h>>32
+	return (lo + uint64(row)*hi) & cm.mask
+}
+
+func (cm *CountMin) reset() {
+	for i := range cm.rows {
+		for j := range cm.rows[i] {
+			cm.rows[i][j] >>= 1
+		}
+	}
+	cm.adds /= 2
+}
@@ -0,0 +1,38 @@
+package sketch
+
+import "testing"
+
+func TestCountMin(t *testing.T) {
+	cm := New(1 << 10)
+	h := cm.Hash("key")
+	for i := 0; i < 20; i++ {
+		cm.Add(h)
+	}
+	if n := cm.Estimate(h); n != MaxCount {
+		t.Fatalf("expected count to saturate at %d: %d", MaxCount, n)
+	}
+	if n := cm.Estimate(cm.Hash("other")); n > 1 {
+		t.Fatalf("unexpected count for unseen key: %d", n)
+	}
+}
+
+func TestCountMinReset(t *testing.T) {
+	// A single counter per row, and a sample size of 10.
+	cm := New(1)
+	h := cm.Hash("key")
+	for i := 0; i < 9; i++ {
+		cm.Add(h)
+	}
+	if n := cm.Estimate(h); n != 9 {
+		t.Fatalf("unexpected count: %d", n)
+	}
+
+	// Reaching the sample size halves every count.
+	cm.Add(h)
+	if n := cm.Estimate(h); n != 5 {
+		t.Fatalf("unexpected count after reset: %d", n)
+	}
+	if cm.adds != 5 {
+		t.Fatalf("unexpected number of adds after reset: %d", cm.adds)
+	}
+}
@@ -4,8 +4,15 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"math"
+	"strconv"
+	"sync"
 	"time"
 
+	"github.com/ryanfowler/distcache"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/watch"
 	v1 "k8s.io/client-go/kubernetes/typed/core/v1"
@@ -13,23 +20,48 @@ import (
 )
 
 type Client struct {
-	client     *v1.CoreV1Client
+	client     v1.CoreV1Interface
 	namespace  string
 	onError    func(error)
 	onNewPeers func(...string)
 	peerSetter PeerSetter
 	portName   string
+
+	weightAnnotation string
+
+	mu sync.Mutex
+	// podWeightValues holds the weight annotation of each peer's pod at the
+	// last refresh, so that pod watch events only trigger a refresh when a
+	// weight changes.
+	podWeightValues map[string]string
 }
 
 type PeerSetter interface {
 	SetPeers(peers ...string)
 }
 
+// WeightedPeerSetter is a PeerSetter that also accepts peer weights, such as
+// a *distcache.Cache.
+type WeightedPeerSetter interface {
+	PeerSetter
+	SetPeerInfos(peers ...distcache.PeerInfo)
+}
+
 type Options struct {
 	Namespace  string
 	PortName   string
 	PeerSetter PeerSetter
 
+	// WeightAnnotation, if set, is the pod annotation that holds each peer's
+	// weight. Pods without the annotation have a weight of 1. Weights are
+	// only used if the PeerSetter is a WeightedPeerSetter.
+	//
+	// Each refresh gets the pods named by the endpoints, and Watch also
+	// watches the namespace's pods for weight changes, so the service
+	// account needs the get and watch permissions on pods, in addition to
+	// list and watch on endpoints.
+	WeightAnnotation string
+
 	OnError    func(err error)
 	OnNewPeers func(peers ...string)
 }
@@ -43,6 +75,10 @@ func New(opts Options) (*Client, error) {
 	if err != nil {
 		return nil, err
 	}
+	return newClient(client, opts), nil
+}
+
+func newClient(client v1.CoreV1Interface, opts Options) *Client {
 	return &Client{
 		client:     client,
 		namespace:  opts.Namespace,
@@ -50,7 +86,9 @@ func New(opts Options) (*Client, error) {
 		onNewPeers: opts.OnNewPeers,
 		peerSetter: opts.PeerSetter,
 		portName:   opts.PortName,
-	}, nil
+
+		weightAnnotation: opts.WeightAnnotation,
+	}
 }
 
 func (c *Client) RefreshPeers(ctx context.Context) error {
@@ -62,7 +100,8 @@ func (c *Client) RefreshPeers(ctx context.Context) error {
 		return err
 	}
 
-	var peers []string
+	var peers []distcache.PeerInfo
+	var pods []string
 	for _, item := range es.Items {
 		for _, subset := range item.Subsets {
 			for _, addr := range subset.Addresses {
@@ -70,21 +109,101 @@ func (c *Client) RefreshPeers(ctx context.Context) error {
 					if port.Name != c.portName {
 						continue
 					}
-					peers = append(peers, fmt.Sprintf("%s:%d", addr.IP, port.Port))
+					peers = append(peers, distcache.PeerInfo{Addr: fmt.Sprintf("%s:%d", addr.IP, port.Port)})
+					var pod string
+					if ref := addr.TargetRef; ref != nil && ref.Kind == "Pod" {
+						pod = ref.Name
+					}
+					pods = append(pods, pod)
 					break
 				}
 			}
 		}
 	}
 
+	addrs := make([]string, len(peers))
+	for i, peer := range peers {
+		addrs[i] = peer.Addr
+	}
 	if c.onNewPeers != nil {
-		c.onNewPeers(peers...)
+		c.onNewPeers(addrs...)
 	}
 
-	c.peerSetter.SetPeers(peers...)
+	ws, ok := c.peerSetter.(WeightedPeerSetter)
+	if !ok || c.weightAnnotation == "" {
+		c.peerSetter.SetPeers(addrs...)
+		return nil
+	}
+	weights, err := c.podWeights(ctx, pods)
+	if err != nil {
+		return err
+	}
+	for i, pod := range pods {
+		peers[i].Weight = weights[pod]
+	}
+	ws.SetPeerInfos(peers...)
 	return nil
 }
 
+// podWeights returns the weight of each of the named pods with the weight
+// annotation.
+func (c *Client) podWeights(ctx context.Context, pods []string) (map[string]float64, error) {
+	weights := make(map[string]float64, len(pods))
+	values := make(map[string]string, len(pods))
+	for _, name := range pods {
+		if _, ok := values[name]; ok || name == "" {
+			continue
+		}
+		pod, err := c.client.Pods(c.namespace).Get(ctx, name, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			// The pod was deleted, and the endpoints will soon follow.
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		val, ok := pod.Annotations[c.weightAnnotation]
+		values[name] = val
+		if !ok {
+			continue
+		}
+		weight, err := strconv.ParseFloat(val, 64)
+		if err != nil || !(weight > 0) || math.IsInf(weight, 0) {
+			// Fall back to the default weight, rather than failing to
+			// refresh every peer.
+			if c.onError != nil {
+				c.onError(fmt.Errorf("pod %s: invalid weight %q", name, val))
+			}
+			continue
+		}
+		weights[name] = weight
+	}
+
+	c.mu.Lock()
+	c.podWeightValues = values
+	c.mu.Unlock()
+	return weights, nil
+}
+
+// weighted returns whether peers are refreshed with their pods' weights.
+func (c *Client) weighted() bool {
+	_, ok := c.peerSetter.(WeightedPeerSetter)
+	return ok && c.weightAnnotation != ""
+}
+
+// weightChanged returns whether a pod watch event changed the weight of a
+// peer's pod since the last refresh.
+func (c *Client) weightChanged(event watch.Event) bool {
+	pod, ok := event.Object.(*corev1.Pod)
+	if !ok || event.Type != watch.Modified {
+		return false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	val, ok := c.podWeightValues[pod.Name]
+	return ok && pod.Annotations[c.weightAnnotation] != val
+}
+
 func (c *Client) Watch(ctx context.Context) error {
 	for {
 		err := c.watch(ctx)
@@ -100,30 +219,55 @@ func (c *Client) Watch(ctx context.Context) error {
 }
 
 func (c *Client) watch(ctx context.Context) error {
-	i, err := c.client.Endpoints(c.namespace).Watch(ctx, metav1.ListOptions{Watch: true})
+	endpoints, err := c.client.Endpoints(c.namespace).Watch(ctx, metav1.ListOptions{Watch: true})
 	if err != nil {
 		return err
 	}
-	defer i.Stop()
+	defer endpoints.Stop()
+
+	// Weights are pod annotations, so changes to them don't change the
+	// endpoints.
+	var podEvents <-chan watch.Event
+	if c.weighted() {
+		pods, err := c.client.Pods(c.namespace).Watch(ctx, metav1.ListOptions{Watch: true})
+		if err != nil {
+			return err
+		}
+		defer pods.Stop()
+		podEvents = pods.ResultChan()
+	}
+
 	for {
-		if err = c.waitToRefresh(ctx, i); err != nil {
+		if err = c.waitToRefresh(ctx, endpoints.ResultChan(), podEvents); err != nil {
 			return err
 		}
 	}
 }
 
-func (c *Client) waitToRefresh(ctx context.Context, i watch.Interface) error {
+func (c *Client) waitToRefresh(ctx context.Context, endpoints, pods <-chan watch.Event) error {
 	timer := time.NewTimer(10 * time.Minute)
 	defer timer.Stop()
 
-	select {
-	case <-ctx.Done():
-		return ctx.Err()
-	case _, ok := <-i.ResultChan():
-		if !ok {
-			return errors.New("watch channel closed")
+wait:
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case _, ok := <-endpoints:
+			if !ok {
+				return errors.New("watch channel closed")
+			}
+			break wait
+		case event, ok := <-pods:
+			if !ok {
+				return errors.New("pod watch channel closed")
+			}
+			if c.weightChanged(event) {
+				break wait
+			}
+		case <-timer.C:
+			break wait
 		}
-	case <-timer.C:
 	}
 
 	for {
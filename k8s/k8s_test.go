@@ -0,0 +1,177 @@
+package k8s
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ryanfowler/distcache"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestRefreshPeersWeights(t *testing.T) {
+	ctx := context.Background()
+	clientset := fake.NewClientset(
+		testEndpoints("pod-a", "pod-b", "pod-c"),
+		testPod("pod-a", "2"),
+		testPod("pod-b", "invalid"),
+		testPod("pod-c", ""),
+		testPod("unrelated", "5"),
+	)
+	setter := &peerSetter{}
+	var errs []error
+	client := newClient(clientset.CoreV1(), Options{
+		Namespace:        "default",
+		PortName:         "distcache",
+		PeerSetter:       setter,
+		WeightAnnotation: "distcache/weight",
+		OnError:          func(err error) { errs = append(errs, err) },
+	})
+
+	if err := client.RefreshPeers(ctx); err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	want := []distcache.PeerInfo{
+		{Addr: "10.0.0.1:8080", Weight: 2},
+		{Addr: "10.0.0.2:8080"},
+		{Addr: "10.0.0.3:8080"},
+	}
+	if peers := setter.get(); !slices.Equal(peers, want) {
+		t.Fatalf("unexpected peers: %v", peers)
+	}
+	if len(errs) != 1 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+
+	// Only the pods backing the endpoints are fetched.
+	for _, action := range clientset.Actions() {
+		if action.GetResource().Resource != "pods" {
+			continue
+		}
+		if action.GetVerb() != "get" {
+			t.Fatalf("unexpected pod request: %s", action.GetVerb())
+		}
+	}
+}
+
+func TestWatchPodWeights(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	clientset := fake.NewClientset(testEndpoints("pod-a"), testPod("pod-a", "1"))
+	setter := &peerSetter{}
+	client := newClient(clientset.CoreV1(), Options{
+		Namespace:        "default",
+		PortName:         "distcache",
+		PeerSetter:       setter,
+		WeightAnnotation: "distcache/weight",
+	})
+	if err := client.RefreshPeers(ctx); err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	defer cancel()
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		_ = client.Watch(ctx)
+	}()
+
+	// Changing a pod's weight refreshes the peers, even though the
+	// endpoints don't change. Keep updating the pod until the watch has
+	// started and seen it.
+	pods := clientset.CoreV1().Pods("default")
+	deadline := time.Now().Add(10 * time.Second)
+	for i := 0; ; i++ {
+		if peers := setter.get(); len(peers) == 1 && peers[0].Weight == 3 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("peers not refreshed after weight change: %v", setter.get())
+		}
+		pod := testPod("pod-a", "3")
+		pod.Annotations["tick"] = strconv.Itoa(i)
+		if _, err := pods.Update(ctx, pod, metav1.UpdateOptions{}); err != nil {
+			t.Fatalf("unexpected error: %s", err.Error())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestWeightChanged(t *testing.T) {
+	client := newClient(fake.NewClientset().CoreV1(), Options{WeightAnnotation: "distcache/weight"})
+	client.podWeightValues = map[string]string{"pod-a": "1"}
+	for _, tc := range []struct {
+		pod     *corev1.Pod
+		changed bool
+	}{
+		{testPod("pod-a", "1"), false},
+		{testPod("pod-a", "2"), true},
+		{testPod("unrelated", "2"), false},
+	} {
+		if changed := client.weightChanged(watchEvent(tc.pod)); changed != tc.changed {
+			t.Fatalf("unexpected change for %s=%s: %t", tc.pod.Name, tc.pod.Annotations["distcache/weight"], changed)
+		}
+	}
+}
+
+func testEndpoints(pods ...string) *corev1.Endpoints {
+	subset := corev1.EndpointSubset{
+		Ports: []corev1.EndpointPort{{Name: "metrics", Port: 9090}, {Name: "distcache", Port: 8080}},
+	}
+	for i, pod := range pods {
+		subset.Addresses = append(subset.Addresses, corev1.EndpointAddress{
+			IP:        "10.0.0." + strconv.Itoa(i+1),
+			TargetRef: &corev1.ObjectReference{Kind: "Pod", Name: pod, Namespace: "default"},
+		})
+	}
+	return &corev1.Endpoints{
+		ObjectMeta: metav1.ObjectMeta{Name: "distcache", Namespace: "default"},
+		Subsets:    []corev1.EndpointSubset{subset},
+	}
+}
+
+func testPod(name, weight string) *corev1.Pod {
+	pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{
+		Name:        name,
+		Namespace:   "default",
+		Annotations: map[string]string{},
+	}}
+	if weight != "" {
+		pod.Annotations["distcache/weight"] = weight
+	}
+	return pod
+}
+
+type peerSetter struct {
+	mu    sync.Mutex
+	peers []distcache.PeerInfo
+}
+
+func (s *peerSetter) SetPeers(peers ...string) {
+	panic(errors.New("expected weighted peers"))
+}
+
+func (s *peerSetter) SetPeerInfos(peers ...distcache.PeerInfo) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.peers = peers
+}
+
+func (s *peerSetter) get() []distcache.PeerInfo {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.peers
+}
+
+func watchEvent(pod *corev1.Pod) watch.Event {
+	return watch.Event{Type: watch.Modified, Object: pod}
+}
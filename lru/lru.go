@@ -26,6 +26,7 @@ import (
 	"container/list"
 	"context"
 	"sync"
+	"time"
 
 	"github.com/ryanfowler/distcache"
 )
@@ -34,35 +35,105 @@ var _ distcache.Store = (*LRU)(nil)
 
 type LRU struct {
 	maxBytes int
+	now      func() time.Time
 
-	mu      sync.Mutex
-	size    int
-	valList *list.List
-	values  map[string]*lruValue
+	mu        sync.Mutex
+	size      int
+	evictions uint64
+	valList   *list.List
+	values    map[string]*lruValue
+	onEvict   func(key string, val []byte, reason EvictReason)
+	evicted   []eviction
 }
 
 type lruValue struct {
-	key  string
-	val  []byte
-	elem *list.Element
+	key     string
+	val     []byte
+	expires time.Time
+	meta    Metadata
+	elem    *list.Element
+}
+
+// EvictReason is the reason that a value was removed from an LRU.
+type EvictReason int
+
+const (
+	// EvictCapacity means the value was evicted to stay within maxBytes.
+	EvictCapacity EvictReason = iota
+	// EvictDelete means the value was removed by Delete.
+	EvictDelete
+	// EvictExpired means the value's TTL elapsed.
+	EvictExpired
+	// EvictReplace means the value was replaced by Set.
+	EvictReplace
+)
+
+func (r EvictReason) String() string {
+	switch r {
+	case EvictCapacity:
+		return "capacity"
+	case EvictDelete:
+		return "delete"
+	case EvictExpired:
+		return "expired"
+	case EvictReplace:
+		return "replace"
+	default:
+		return "unknown"
+	}
+}
+
+type eviction struct {
+	key    string
+	val    []byte
+	reason EvictReason
+}
+
+// Metadata describes a value in an LRU.
+type Metadata struct {
+	// Inserted is when the value was set.
+	Inserted time.Time
+	// Accessed is when the value was last returned by Get, or set.
+	Accessed time.Time
+	// Hits is the number of times the value has been returned by Get.
+	Hits uint64
+	// Expires is when the value expires, or zero if it never expires.
+	Expires time.Time
+}
+
+func (v *lruValue) expired(now time.Time) bool {
+	return !v.expires.IsZero() && !now.Before(v.expires)
 }
 
 func New(maxBytes int) *LRU {
 	return &LRU{
 		maxBytes: maxBytes,
+		now:      time.Now,
 		valList:  list.New(),
 		values:   make(map[string]*lruValue),
 	}
 }
 
-func (l *LRU) Get(ctx context.Context, key string) ([]byte, error) {
+func (l *LRU) Get(ctx context.Context, key string) ([]byte, time.Duration, error) {
 	l.mu.Lock()
-	defer l.mu.Unlock()
-	if value, ok := l.values[key]; ok {
-		l.valList.MoveToFront(value.elem)
-		return value.val, nil
+	defer l.unlock()
+	value, ok := l.values[key]
+	if !ok {
+		return nil, 0, nil
+	}
+	now := l.now()
+	if value.expired(now) {
+		l.remove(value, EvictExpired)
+		return nil, 0, nil
 	}
-	return nil, nil
+	var ttl time.Duration
+	if !value.expires.IsZero() {
+		ttl = value.expires.Sub(now)
+	}
+	value.meta.Accessed = now
+	value.meta.Hits++
+	l.valList.MoveToFront(value.elem)
+	return value.val, ttl, nil
 }
 
 func (l *LRU) Len() int {
@@ -77,32 +148,78 @@ func (l *LRU) Size() int {
 	return l.size
 }
 
+// Evictions returns the number of values that have been evicted to stay
+// within maxBytes.
+func (l *LRU) Evictions() uint64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.evictions
+}
+
 func (l *LRU) Range(fn func(key string, val []byte) bool) {
+	l.RangeMetadata(func(key string, val []byte, _ Metadata) bool {
+		return fn(key, val)
+	})
+}
+
+// RangeMetadata is like Range, but also passes the metadata for each value.
+func (l *LRU) RangeMetadata(fn func(key string, val []byte, meta Metadata) bool) {
 	l.mu.Lock()
 	defer l.mu.Unlock()
+	now := l.now()
 	for e := l.valList.Front(); e != nil; e = e.Next() {
 		value := e.Value.(*lruValue)
-		if !fn(value.key, value.val) {
+		if value.expired(now) {
+			continue
+		}
+		if !fn(value.key, value.val, value.meta) {
 			return
 		}
 	}
 }
 
-func (l *LRU) Set(ctx context.Context, key string, val []byte) error {
+// OnEvict sets fn to be called whenever a value is removed from the LRU,
+// along with the reason it was removed. fn is called after the LRU is
+// unlocked, so it may use the LRU.
+func (l *LRU) OnEvict(fn func(key string, val []byte, reason EvictReason)) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.onEvict = fn
+}
+
+func (l *LRU) Set(ctx context.Context, key string, val []byte, ttl time.Duration) error {
 	if val == nil {
 		return nil
 	}
 
 	l.mu.Lock()
-	defer l.mu.Unlock()
+	defer l.unlock()
+
+	if ttl < 0 {
+		// The value has already expired.
+		if value, ok := l.values[key]; ok {
+			l.remove(value, EvictExpired)
+		}
+		return nil
+	}
+
+	now := l.now()
+	var expires time.Time
+	if ttl > 0 {
+		expires = now.Add(ttl)
+	}
+	meta := Metadata{Inserted: now, Accessed: now, Expires: expires}
 
 	if value, ok := l.values[key]; ok {
+		l.notify(value.key, value.val, EvictReplace)
 		l.size += len(val) - len(value.val)
 		value.val = val
+		value.expires = expires
+		value.meta = meta
 		l.valList.MoveToFront(value.elem)
 	} else {
 		l.size += len(key) + len(val)
-		value = &lruValue{key: key, val: val}
+		value = &lruValue{key: key, val: val, expires: expires, meta: meta}
 		value.elem = l.valList.PushFront(value)
 		l.values[key] = value
 	}
@@ -111,14 +228,54 @@ func (l *LRU) Set(ctx context.Context, key string, val []byte) error {
 	return nil
 }
 
+func (l *LRU) Delete(ctx context.Context, key string) error {
+	l.mu.Lock()
+	defer l.unlock()
+	if value, ok := l.values[key]; ok {
+		l.remove(value, EvictDelete)
+	}
+	return nil
+}
+
 func (l *LRU) evict() {
+	now := l.now()
 	for l.size > l.maxBytes {
 		tail := l.valList.Back()
 		if tail == nil {
 			return
 		}
-		value := l.valList.Remove(tail).(*lruValue)
-		delete(l.values, value.key)
-		l.size -= (len(value.key) + len(value.val))
+		value := tail.Value.(*lruValue)
+		if value.expired(now) {
+			l.remove(value, EvictExpired)
+			continue
+		}
+		l.remove(value, EvictCapacity)
+		l.evictions++
+	}
+}
+
+func (l *LRU) remove(value *lruValue, reason EvictReason) {
+	l.valList.Remove(value.elem)
+	delete(l.values, value.key)
+	l.size -= (len(value.key) + len(value.val))
+	l.notify(value.key, value.val, reason)
+}
+
+// notify queues a call to the eviction callback, to be made once the LRU is
+// unlocked.
+func (l *LRU) notify(key string, val []byte, reason EvictReason) {
+	if l.onEvict != nil {
+		l.evicted = append(l.evicted, eviction{key: key, val: val, reason: reason})
+	}
+}
+
+// unlock unlocks the LRU, then calls the eviction callback for the values
+// removed while it was locked.
+func (l *LRU) unlock() {
+	evicted, onEvict := l.evicted, l.onEvict
+	l.evicted = nil
+	l.mu.Unlock()
+	for _, e := range evicted {
+		onEvict(e.key, e.val, e.reason)
 	}
 }
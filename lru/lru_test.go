@@ -0,0 +1,208 @@
+package lru
+
+import (
+	"context"
+	"math/rand/v2"
+	"slices"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ryanfowler/distcache"
+)
+
+func TestLRUExpiry(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now()
+	l := New(1 << 10)
+	l.now = func() time.Time { return now }
+
+	if err := l.Set(ctx, "forever", []byte("value"), 0); err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	if err := l.Set(ctx, "expiring", []byte("value"), time.Minute); err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+
+	now = now.Add(15 * time.Second)
+	val, ttl, _ := l.Get(ctx, "expiring")
+	if string(val) != "value" {
+		t.Fatalf("unexpected value: %q", val)
+	}
+	if ttl != 45*time.Second {
+		t.Fatalf("unexpected ttl: %s", ttl)
+	}
+
+	now = now.Add(time.Minute)
+	if val, _, _ = l.Get(ctx, "expiring"); val != nil {
+		t.Fatalf("unexpected value after expiry: %q", val)
+	}
+	if l.Len() != 1 {
+		t.Fatalf("unexpected length: %d", l.Len())
+	}
+	if l.Size() != len("forever")+len("value") {
+		t.Fatalf("unexpected size: %d", l.Size())
+	}
+	val, ttl, _ = l.Get(ctx, "forever")
+	if string(val) != "value" || ttl != 0 {
+		t.Fatalf("unexpected value and ttl: %q, %s", val, ttl)
+	}
+}
+
+func TestSharded(t *testing.T) {
+	ctx := context.Background()
+	s := NewSharded(8, 8<<10)
+
+	for i := 0; i < 100; i++ {
+		key := strconv.Itoa(i)
+		if err := s.Set(ctx, key, []byte("value"+key), 0); err != nil {
+			t.Fatalf("unexpected error: %s", err.Error())
+		}
+	}
+	for i := 0; i < 100; i++ {
+		key := strconv.Itoa(i)
+		if val, _, _ := s.Get(ctx, key); string(val) != "value"+key {
+			t.Fatalf("unexpected value for %q: %q", key, val)
+		}
+	}
+	if s.Len() != 100 {
+		t.Fatalf("unexpected length: %d", s.Len())
+	}
+
+	var size, n int
+	s.Range(func(key string, val []byte) bool {
+		size += len(key) + len(val)
+		n++
+		return true
+	})
+	if n != 100 || size != s.Size() {
+		t.Fatalf("unexpected range: %d entries, %d bytes (size %d)", n, size, s.Size())
+	}
+	n = 0
+	s.Range(func(key string, val []byte) bool {
+		n++
+		return n < 10
+	})
+	if n != 10 {
+		t.Fatalf("range didn't stop: %d", n)
+	}
+
+	_ = s.Delete(ctx, "0")
+	if val, _, _ := s.Get(ctx, "0"); val != nil {
+		t.Fatalf("unexpected value after delete: %q", val)
+	}
+
+	// Each shard evicts within its share of the budget.
+	for i := 0; i < 1000; i++ {
+		_ = s.Set(ctx, "big"+strconv.Itoa(i), make([]byte, 100), 0)
+	}
+	if s.Size() > 8<<10 || s.Evictions() == 0 {
+		t.Fatalf("unexpected size %d with %d evictions", s.Size(), s.Evictions())
+	}
+}
+
+func BenchmarkLRU(b *testing.B) {
+	benchmarkStore(b, New(64<<20))
+}
+
+func BenchmarkSharded(b *testing.B) {
+	benchmarkStore(b, NewSharded(64, 64<<20))
+}
+
+// benchmarkStore measures parallel reads and writes, with one write for
+// every ten reads, over a key space that fits in the store.
+func benchmarkStore(b *testing.B, store distcache.Store) {
+	ctx := context.Background()
+	const numKeys = 1 << 14
+	keys := make([]string, numKeys)
+	val := make([]byte, 128)
+	for i := range keys {
+		keys[i] = "key" + strconv.Itoa(i)
+		_ = store.Set(ctx, keys[i], val, 0)
+	}
+
+	var seed atomic.Uint64
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		rng := rand.New(rand.NewPCG(seed.Add(1), 0))
+		for pb.Next() {
+			key := keys[rng.IntN(numKeys)]
+			if rng.IntN(10) == 0 {
+				_ = store.Set(ctx, key, val, 0)
+			} else {
+				_, _, _ = store.Get(ctx, key)
+			}
+		}
+	})
+}
+
+func TestLRUOnEvict(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now()
+	l := New(19)
+	l.now = func() time.Time { return now }
+
+	var evicted []string
+	l.OnEvict(func(key string, val []byte, reason EvictReason) {
+		// The callback is made without holding the lock.
+		_ = l.Len()
+		evicted = append(evicted, key+"="+string(val)+":"+reason.String())
+	})
+
+	_ = l.Set(ctx, "a", []byte("1"), 0)
+	_ = l.Set(ctx, "a", []byte("2"), 0)
+	_ = l.Set(ctx, "b", []byte("1"), time.Second)
+	_ = l.Delete(ctx, "a")
+	now = now.Add(time.Second)
+	_, _, _ = l.Get(ctx, "b")
+	_ = l.Set(ctx, "c", []byte("123456789"), 0)
+	_ = l.Set(ctx, "d", []byte("123456789"), 0)
+	_ = l.Set(ctx, "e", []byte("1"), -1)
+
+	want := []string{
+		"a=1:replace",
+		"a=2:delete",
+		"b=1:expired",
+		"c=123456789:capacity",
+	}
+	if !slices.Equal(evicted, want) {
+		t.Fatalf("unexpected evictions: %v", evicted)
+	}
+	if n := l.Evictions(); n != 1 {
+		t.Fatalf("unexpected number of evictions: %d", n)
+	}
+}
+
+func TestLRUMetadata(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now()
+	l := New(1 << 10)
+	l.now = func() time.Time { return now }
+
+	inserted := now
+	_ = l.Set(ctx, "key", []byte("value"), time.Minute)
+	now = now.Add(time.Second)
+	_, _, _ = l.Get(ctx, "key")
+	now = now.Add(time.Second)
+	_, _, _ = l.Get(ctx, "key")
+
+	var metas []Metadata
+	l.RangeMetadata(func(key string, val []byte, meta Metadata) bool {
+		metas = append(metas, meta)
+		return true
+	})
+	want := Metadata{Inserted: inserted, Accessed: now, Hits: 2, Expires: inserted.Add(time.Minute)}
+	if len(metas) != 1 || metas[0] != want {
+		t.Fatalf("unexpected metadata: %+v", metas)
+	}
+
+	// Replacing a value resets its metadata.
+	_ = l.Set(ctx, "key", []byte("value"), 0)
+	l.RangeMetadata(func(key string, val []byte, meta Metadata) bool {
+		if meta != (Metadata{Inserted: now, Accessed: now}) {
+			t.Fatalf("unexpected metadata after replace: %+v", meta)
+		}
+		return true
+	})
+}
@@ -0,0 +1,141 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2020 Ryan Fowler
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package lru
+
+import (
+	"context"
+	"time"
+
+	"github.com/ryanfowler/distcache"
+)
+
+var _ distcache.Store = (*Sharded)(nil)
+
+// Sharded is an LRU split into independent shards selected by key hash, so
+// that concurrent operations on different keys don't contend on one mutex.
+// Each shard evicts its own least recently used values to stay within its
+// share of the byte budget.
+type Sharded struct {
+	shards []*LRU
+}
+
+// NewSharded returns a Sharded LRU with the provided number of shards, each
+// holding up to maxBytes/shards bytes.
+func NewSharded(shards, maxBytes int) *Sharded {
+	shards = max(shards, 1)
+	s := &Sharded{shards: make([]*LRU, shards)}
+	for i := range s.shards {
+		s.shards[i] = New(maxBytes / shards)
+	}
+	return s
+}
+
+func (s *Sharded) Get(ctx context.Context, key string) ([]byte, time.Duration, error) {
+	return s.shard(key).Get(ctx, key)
+}
+
+func (s *Sharded) Set(ctx context.Context, key string, val []byte, ttl time.Duration) error {
+	return s.shard(key).Set(ctx, key, val, ttl)
+}
+
+func (s *Sharded) Delete(ctx context.Context, key string) error {
+	return s.shard(key).Delete(ctx, key)
+}
+
+func (s *Sharded) Len() int {
+	var n int
+	for _, shard := range s.shards {
+		n += shard.Len()
+	}
+	return n
+}
+
+func (s *Sharded) Size() int {
+	var n int
+	for _, shard := range s.shards {
+		n += shard.Size()
+	}
+	return n
+}
+
+// Evictions returns the number of values that have been evicted from all
+// shards.
+func (s *Sharded) Evictions() uint64 {
+	var n uint64
+	for _, shard := range s.shards {
+		n += shard.Evictions()
+	}
+	return n
+}
+
+// Range calls fn for each value, shard by shard. Values are ordered from the
+// most recently used within each shard, but not across shards.
+func (s *Sharded) Range(fn func(key string, val []byte) bool) {
+	for _, shard := range s.shards {
+		stopped := false
+		shard.Range(func(key string, val []byte) bool {
+			if !fn(key, val) {
+				stopped = true
+				return false
+			}
+			return true
+		})
+		if stopped {
+			return
+		}
+	}
+}
+
+// RangeMetadata is like Range, but also passes the metadata for each value.
+func (s *Sharded) RangeMetadata(fn func(key string, val []byte, meta Metadata) bool) {
+	for _, shard := range s.shards {
+		stopped := false
+		shard.RangeMetadata(func(key string, val []byte, meta Metadata) bool {
+			if !fn(key, val, meta) {
+				stopped = true
+				return false
+			}
+			return true
+		})
+		if stopped {
+			return
+		}
+	}
+}
+
+// OnEvict sets fn to be called whenever a value is removed from any shard.
+func (s *Sharded) OnEvict(fn func(key string, val []byte, reason EvictReason)) {
+	for _, shard := range s.shards {
+		shard.OnEvict(fn)
+	}
+}
+
+func (s *Sharded) shard(key string) *LRU {
+	// FNV-1a, inlined to avoid allocating a hash.Hash per operation.
+	h := uint32(2166136261)
+	for i := 0; i < len(key); i++ {
+		h ^= uint32(key[i])
+		h *= 16777619
+	}
+	return s.shards[h%uint32(len(s.shards))]
+}
@@ -0,0 +1,441 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2020 Ryan Fowler
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+// Package metrics collects metrics from a distcache.Cache, its stores, and its
+// gRPC clients and server, and exports them in the Prometheus text exposition
+// format.
+package metrics
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ryanfowler/distcache"
+)
+
+var _ distcache.Observer = (*Registry)(nil)
+
+// DefaultBuckets are the histogram buckets used for latencies, in seconds.
+var DefaultBuckets = []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Registry holds the metrics for a Cache. It's a distcache.Observer, and an
+// http.Handler that serves the metrics in the Prometheus text format.
+type Registry struct {
+	gets           *counterVec
+	getErrors      *counterVec
+	getDuration    *histogramVec
+	shared         *counterVec
+	getterDuration *histogramVec
+	getterErrors   *counterVec
+	fallbacks      *counterVec
+	storeErrors    *counterVec
+	refreshErrors  *counterVec
+	peers          *gaugeVec
+	ejections      *counterVec
+	handoffBytes   *counterVec
+	handoffErrors  *counterVec
+
+	peerRPCDuration   *histogramVec
+	peerRPCErrors     *counterVec
+	serverRPCDuration *histogramVec
+	serverRPCErrors   *counterVec
+
+	mu     sync.Mutex
+	stores map[string]StoreStats
+}
+
+// StoreStats is implemented by stores that can report their size, such as
+// lru.LRU.
+type StoreStats interface {
+	Len() int
+	Size() int
+	Evictions() uint64
+}
+
+func New() *Registry {
+	return &Registry{
+		gets: newCounterVec("distcache_gets_total",
+			"Number of keys retrieved from the cache, by result source.", "source"),
+		getErrors: newCounterVec("distcache_get_errors_total",
+			"Number of keys that could not be retrieved from the cache."),
+		getDuration: newHistogramVec("distcache_get_duration_seconds",
+			"Latency of retrieving keys from the cache."),
+		shared: newCounterVec("distcache_singleflight_shared_total",
+			"Number of keys that joined a load already in flight."),
+		getterDuration: newHistogramVec("distcache_getter_duration_seconds",
+			"Latency of calls to the Getter."),
+		getterErrors: newCounterVec("distcache_getter_errors_total",
+			"Number of calls to the Getter that returned an error."),
+		fallbacks: newCounterVec("distcache_fallbacks_total",
+			"Number of keys retrieved locally instead of from their owner, by owner.", "peer"),
+		storeErrors: newCounterVec("distcache_store_errors_total",
+			"Number of store operations that returned an error.", "store", "op"),
+		refreshErrors: newCounterVec("distcache_refresh_errors_total",
+			"Number of background refreshes that returned an error."),
+		peers: newGaugeVec("distcache_peers",
+			"Number of remote peers."),
+		peerRPCDuration: newHistogramVec("distcache_peer_rpc_duration_seconds",
+			"Latency of requests to peers.", "peer", "method"),
+		peerRPCErrors: newCounterVec("distcache_peer_rpc_errors_total",
+			"Number of requests to peers that returned an error.", "peer", "method"),
+		serverRPCDuration: newHistogramVec("distcache_server_rpc_duration_seconds",
+			"Latency of requests handled for peers.", "method"),
+		serverRPCErrors: newCounterVec("distcache_server_rpc_errors_total",
+			"Number of requests handled for peers that returned an error.", "method"),
+		ejections: newCounterVec("distcache_peer_ejections_total",
+			"Number of times peers were ejected from routing.", "peer"),
+		handoffBytes: newCounterVec("distcache_handoff_bytes_total",
+			"Number of bytes handed off to new owners.", "peer"),
+		handoffErrors: newCounterVec("distcache_handoff_errors_total",
+			"Number of handoff requests that returned an error.", "peer"),
+		stores: make(map[string]StoreStats),
+	}
+}
+
+// RegisterStore reports the size of store, labelled with name.
+func (r *Registry) RegisterStore(name string, store StoreStats) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.stores[name] = store
+}
+
+func (r *Registry) Observe(ctx context.Context, event distcache.Event) {
+	switch e := event.(type) {
+	case distcache.GetEvent:
+		if e.Err != nil {
+			r.getErrors.inc()
+		} else {
+			r.gets.inc(e.Source.String())
+		}
+		if e.Shared {
+			r.shared.inc()
+		}
+		r.getDuration.observe(e.Latency)
+	case distcache.GetterEvent:
+		r.getterDuration.observe(e.Latency)
+		if e.Err != nil {
+			r.getterErrors.inc()
+		}
+	case distcache.FallbackEvent:
+		r.fallbacks.add(float64(len(e.Keys)), e.Peer)
+	case distcache.StoreEvent:
+		if e.Err != nil {
+			r.storeErrors.inc(e.Store.String(), e.Op.String())
+		}
+	case distcache.RefreshEvent:
+		if e.Err != nil {
+			r.refreshErrors.inc()
+		}
+	case distcache.PeerAddedEvent:
+		r.peers.add(1)
+	case distcache.PeerRemovedEvent:
+		r.peers.add(-1)
+	case distcache.PeerHealthEvent:
+		if e.State == distcache.PeerEjected {
+			r.ejections.inc(e.Peer)
+		}
+	case distcache.HandoffEvent:
+		if e.Err != nil {
+			r.handoffErrors.inc(e.Peer)
+		} else {
+			r.handoffBytes.add(float64(e.Bytes), e.Peer)
+		}
+	}
+}
+
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	_, _ = r.WriteTo(w)
+}
+
+// WriteTo writes all metrics to w in the Prometheus text exposition format.
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	cw := &countingWriter{w: bufio.NewWriter(w)}
+
+	r.gets.write(cw)
+	r.getErrors.write(cw)
+	r.getDuration.write(cw)
+	r.shared.write(cw)
+	r.getterDuration.write(cw)
+	r.getterErrors.write(cw)
+	r.fallbacks.write(cw)
+	r.storeErrors.write(cw)
+	r.refreshErrors.write(cw)
+	r.peers.write(cw)
+	r.ejections.write(cw)
+	r.handoffBytes.write(cw)
+	r.handoffErrors.write(cw)
+	r.peerRPCDuration.write(cw)
+	r.peerRPCErrors.write(cw)
+	r.serverRPCDuration.write(cw)
+	r.serverRPCErrors.write(cw)
+	r.writeStores(cw)
+
+	if cw.err == nil {
+		cw.err = cw.w.Flush()
+	}
+	return cw.n, cw.err
+}
+
+func (r *Registry) writeStores(w *countingWriter) {
+	bytes := newGaugeVec("distcache_store_bytes", "Number of bytes held by the store.", "store")
+	items := newGaugeVec("distcache_store_items", "Number of items held by the store.", "store")
+	evictions := newCounterVec("distcache_store_evictions_total",
+		"Number of items evicted from the store to make space.", "store")
+
+	r.mu.Lock()
+	for name, store := range r.stores {
+		bytes.set(float64(store.Size()), name)
+		items.set(float64(store.Len()), name)
+		evictions.add(float64(store.Evictions()), name)
+	}
+	r.mu.Unlock()
+
+	bytes.write(w)
+	items.write(w)
+	evictions.write(w)
+}
+
+type countingWriter struct {
+	w   *bufio.Writer
+	n   int64
+	err error
+}
+
+func (cw *countingWriter) printf(format string, args ...interface{}) {
+	if cw.err != nil {
+		return
+	}
+	n, err := fmt.Fprintf(cw.w, format, args...)
+	cw.n += int64(n)
+	cw.err = err
+}
+
+type metric struct {
+	name   string
+	help   string
+	labels []string
+}
+
+func (m *metric) writeHeader(w *countingWriter, typ string) {
+	w.printf("# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, typ)
+}
+
+// vecKey joins label values into a map key.
+func vecKey(values []string) string {
+	return strings.Join(values, "\xff")
+}
+
+func formatLabels(names, values []string, extra ...string) string {
+	if len(names) == 0 && len(extra) == 0 {
+		return ""
+	}
+	var sb strings.Builder
+	sb.WriteByte('{')
+	for i, name := range names {
+		if i > 0 {
+			sb.WriteByte(',')
+		}
+		sb.WriteString(name)
+		sb.WriteString(`="`)
+		sb.WriteString(escapeLabel(values[i]))
+		sb.WriteByte('"')
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		if sb.Len() > 1 {
+			sb.WriteByte(',')
+		}
+		sb.WriteString(extra[i])
+		sb.WriteString(`="`)
+		sb.WriteString(escapeLabel(extra[i+1]))
+		sb.WriteByte('"')
+	}
+	sb.WriteByte('}')
+	return sb.String()
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabel(s string) string {
+	return labelEscaper.Replace(s)
+}
+
+func formatFloat(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "+Inf"
+	case math.IsInf(f, -1):
+		return "-Inf"
+	default:
+		return strconv.FormatFloat(f, 'g', -1, 64)
+	}
+}
+
+type sample struct {
+	values []string
+	value  float64
+}
+
+type counterVec struct {
+	metric
+	typ string
+
+	mu      sync.Mutex
+	samples map[string]*sample
+}
+
+func newCounterVec(name, help string, labels ...string) *counterVec {
+	return &counterVec{
+		metric:  metric{name: name, help: help, labels: labels},
+		typ:     "counter",
+		samples: make(map[string]*sample),
+	}
+}
+
+func (cv *counterVec) inc(values ...string) {
+	cv.add(1, values...)
+}
+
+func (cv *counterVec) add(delta float64, values ...string) {
+	key := vecKey(values)
+	cv.mu.Lock()
+	defer cv.mu.Unlock()
+	s, ok := cv.samples[key]
+	if !ok {
+		s = &sample{values: values}
+		cv.samples[key] = s
+	}
+	s.value += delta
+}
+
+func (cv *counterVec) set(value float64, values ...string) {
+	key := vecKey(values)
+	cv.mu.Lock()
+	defer cv.mu.Unlock()
+	cv.samples[key] = &sample{values: values, value: value}
+}
+
+func (cv *counterVec) write(w *countingWriter) {
+	cv.writeHeader(w, cv.typ)
+
+	cv.mu.Lock()
+	defer cv.mu.Unlock()
+	if len(cv.samples) == 0 && len(cv.labels) == 0 {
+		w.printf("%s 0\n", cv.name)
+		return
+	}
+	for _, key := range sortedKeys(cv.samples) {
+		s := cv.samples[key]
+		w.printf("%s%s %s\n", cv.name, formatLabels(cv.labels, s.values), formatFloat(s.value))
+	}
+}
+
+// gaugeVec is a counterVec that's exposed as a gauge, so that it may go down.
+type gaugeVec struct {
+	*counterVec
+}
+
+func newGaugeVec(name, help string, labels ...string) *gaugeVec {
+	cv := newCounterVec(name, help, labels...)
+	cv.typ = "gauge"
+	return &gaugeVec{cv}
+}
+
+type histogram struct {
+	values []string
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+type histogramVec struct {
+	metric
+	buckets []float64
+
+	mu         sync.Mutex
+	histograms map[string]*histogram
+}
+
+func newHistogramVec(name, help string, labels ...string) *histogramVec {
+	return &histogramVec{
+		metric:     metric{name: name, help: help, labels: labels},
+		buckets:    DefaultBuckets,
+		histograms: make(map[string]*histogram),
+	}
+}
+
+func (hv *histogramVec) observe(d time.Duration, values ...string) {
+	v := d.Seconds()
+	key := vecKey(values)
+
+	hv.mu.Lock()
+	defer hv.mu.Unlock()
+	h, ok := hv.histograms[key]
+	if !ok {
+		h = &histogram{values: values, counts: make([]uint64, len(hv.buckets))}
+		hv.histograms[key] = h
+	}
+	if i := sort.SearchFloat64s(hv.buckets, v); i < len(hv.buckets) {
+		h.counts[i]++
+	}
+	h.count++
+	h.sum += v
+}
+
+func (hv *histogramVec) write(w *countingWriter) {
+	hv.writeHeader(w, "histogram")
+
+	hv.mu.Lock()
+	defer hv.mu.Unlock()
+	for _, key := range sortedKeys(hv.histograms) {
+		h := hv.histograms[key]
+		var cumulative uint64
+		for i, upper := range hv.buckets {
+			cumulative += h.counts[i]
+			w.printf("%s_bucket%s %d\n", hv.name,
+				formatLabels(hv.labels, h.values, "le", formatFloat(upper)), cumulative)
+		}
+		w.printf("%s_bucket%s %d\n", hv.name,
+			formatLabels(hv.labels, h.values, "le", "+Inf"), h.count)
+		labels := formatLabels(hv.labels, h.values)
+		w.printf("%s_sum%s %s\n", hv.name, labels, formatFloat(h.sum))
+		w.printf("%s_count%s %d\n", hv.name, labels, h.count)
+	}
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,58 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ryanfowler/distcache"
+	"github.com/ryanfowler/distcache/lru"
+)
+
+func TestRegistry(t *testing.T) {
+	ctx := context.Background()
+	r := New()
+
+	store := lru.New(1 << 10)
+	_ = store.Set(ctx, "key", []byte("value"), 0)
+	r.RegisterStore("hot", store)
+
+	r.Observe(ctx, distcache.PeerAddedEvent{Peer: "peer1"})
+	r.Observe(ctx, distcache.PeerAddedEvent{Peer: "peer2"})
+	r.Observe(ctx, distcache.PeerRemovedEvent{Peer: "peer2"})
+	r.Observe(ctx, distcache.GetEvent{Source: distcache.ResultHotCache, Latency: time.Millisecond})
+	r.Observe(ctx, distcache.GetEvent{Source: distcache.ResultHotCache, Shared: true, Latency: time.Millisecond})
+	r.Observe(ctx, distcache.GetEvent{Err: errors.New("failed"), Latency: time.Second})
+	r.Observe(ctx, distcache.GetterEvent{Keys: []string{"key"}, Latency: 3 * time.Millisecond})
+	r.Observe(ctx, distcache.FallbackEvent{Peer: `pe"er`, Keys: []string{"a", "b"}})
+
+	var sb strings.Builder
+	if _, err := r.WriteTo(&sb); err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	out := sb.String()
+
+	for _, line := range []string{
+		"# TYPE distcache_gets_total counter",
+		`distcache_gets_total{source="cache_hot"} 2`,
+		"distcache_get_errors_total 1",
+		"distcache_singleflight_shared_total 1",
+		`distcache_get_duration_seconds_bucket{le="0.001"} 2`,
+		`distcache_get_duration_seconds_bucket{le="+Inf"} 3`,
+		"distcache_get_duration_seconds_count 3",
+		`distcache_getter_duration_seconds_bucket{le="0.0025"} 0`,
+		`distcache_getter_duration_seconds_bucket{le="0.005"} 1`,
+		`distcache_fallbacks_total{peer="pe\"er"} 2`,
+		"# TYPE distcache_peers gauge",
+		"distcache_peers 1",
+		`distcache_store_bytes{store="hot"} 8`,
+		`distcache_store_items{store="hot"} 1`,
+		`distcache_store_evictions_total{store="hot"} 0`,
+	} {
+		if !strings.Contains(out, line+"\n") {
+			t.Errorf("missing line %q in output:\n%s", line, out)
+		}
+	}
+}
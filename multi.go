@@ -0,0 +1,416 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2020 Ryan Fowler
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package distcache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// BatchGetter is a Getter that can also get the values for multiple keys at
+// once. Keys missing from the returned map are treated as nil values.
+type BatchGetter interface {
+	Getter
+	GetMulti(ctx context.Context, keys []string) (map[string]Entry, error)
+}
+
+// Entry is a value and its TTL, as returned by a BatchGetter.
+type Entry struct {
+	Value []byte
+	TTL   time.Duration
+}
+
+// KeyErrors maps keys to the errors that occurred while getting their values.
+type KeyErrors map[string]error
+
+func (ke KeyErrors) Error() string {
+	keys := make([]string, 0, len(ke))
+	for key := range ke {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var sb strings.Builder
+	for i, key := range keys {
+		if i > 0 {
+			sb.WriteString("; ")
+		}
+		fmt.Fprintf(&sb, "%q: %s", key, ke[key].Error())
+	}
+	return sb.String()
+}
+
+// orNil returns ke as an error, or nil if it's empty.
+func (ke KeyErrors) orNil() error {
+	if len(ke) == 0 {
+		return nil
+	}
+	return ke
+}
+
+func (ke KeyErrors) add(key string, err error) KeyErrors {
+	if ke == nil {
+		ke = make(KeyErrors)
+	}
+	ke[key] = err
+	return ke
+}
+
+// GetMulti returns the values for multiple keys. Keys that aren't in the local
+// stores are grouped by their owning peer and retrieved with one request per
+// peer. If some keys fail, the remaining results are returned along with a
+// KeyErrors.
+func (c *Cache) GetMulti(ctx context.Context, keys []string) (map[string]Result, error) {
+	if c.closed.Load() {
+		return nil, ErrClosed
+	}
+	start := time.Now()
+	ctx, span := c.startSpan(ctx, "distcache.GetMulti", keys...)
+	defer span.End()
+
+	results := make(map[string]Result, len(keys))
+	var errs KeyErrors
+	var missing []string
+	for _, key := range keys {
+		if _, ok := results[key]; ok {
+			continue
+		}
+		if _, ok := errs[key]; ok {
+			continue
+		}
+		c.admission.Record(key)
+		if res, ok, err := c.getFromStores(ctx, key); ok {
+			if err != nil {
+				errs = errs.add(key, err)
+			} else {
+				res = c.checkFreshness(ctx, key, res)
+				results[key] = res
+			}
+			c.observeGet(ctx, key, res, false, start, err)
+			continue
+		}
+		results[key] = Result{}
+		missing = append(missing, key)
+	}
+	if len(missing) == 0 {
+		return results, errs.orNil()
+	}
+
+	// Every missing key goes through the singleflight group, so that it's
+	// deduplicated with any other in-flight Get or GetMulti calls. The keys
+	// that this call ends up leading are loaded with one batch per owner.
+	// The batch is cancelled once every key in it has been abandoned by all
+	// of its waiters.
+	batchCtx, cancelBatch := c.single.newContext(ctx)
+	var remaining atomic.Int64
+	done := make(chan keyResult, len(missing))
+	pending := make(map[string]*pendingResult, len(missing))
+	var batch []string
+	for _, key := range missing {
+		p := &pendingResult{done: make(chan struct{})}
+		remaining.Add(1)
+		ch, leader, release := c.single.DoChan(ctx, key, func(ctx context.Context) (interface{}, error) {
+			select {
+			case <-p.done:
+				return p.res, p.err
+			case <-ctx.Done():
+				if remaining.Add(-1) == 0 {
+					cancelBatch()
+				}
+				return Result{}, ctx.Err()
+			}
+		})
+		defer release()
+		if leader {
+			pending[key] = p
+			batch = append(batch, key)
+		} else {
+			remaining.Add(-1)
+		}
+		go func() {
+			done <- keyResult{key: key, shared: !leader, res: <-ch}
+		}()
+	}
+	if len(batch) > 0 {
+		go func() {
+			defer cancelBatch()
+			c.loadMulti(batchCtx, batch, pending)
+		}()
+	} else {
+		cancelBatch()
+	}
+
+	for n := 0; n < len(missing); {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case kr := <-done:
+			n++
+			var res Result
+			if kr.res.Err != nil {
+				delete(results, kr.key)
+				errs = errs.add(kr.key, kr.res.Err)
+			} else {
+				res = kr.res.Val.(Result)
+				results[kr.key] = res
+			}
+			c.observeGet(ctx, kr.key, res, kr.shared, start, kr.res.Err)
+		}
+	}
+	return results, errs.orNil()
+}
+
+type keyResult struct {
+	key    string
+	shared bool
+	res    singleflight.Result
+}
+
+type pendingResult struct {
+	done chan struct{}
+	res  Result
+	err  error
+}
+
+func (c *Cache) loadMulti(ctx context.Context, keys []string, pending map[string]*pendingResult) {
+	ctx = c.deletions.startLoad(ctx)
+	c.mu.Lock()
+	picker := c.picker
+	peers := c.peers
+	c.mu.Unlock()
+
+	owners := make(map[string][]string, len(keys))
+	for _, key := range keys {
+		owners[key] = c.owners(picker, key)
+	}
+
+	var wg sync.WaitGroup
+	for addr, keys := range groupByOwner(keys, owners, 0) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results, errs := c.loadMultiFrom(ctx, picker, peers, owners, 0, addr, keys)
+			for _, key := range keys {
+				p := pending[key]
+				p.res, p.err = results[key], errs[key]
+				close(p.done)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// groupByOwner groups keys by the owner at index i of their owners. Keys
+// without an owner at i are grouped under an empty address.
+func groupByOwner(keys []string, owners map[string][]string, i int) map[string][]string {
+	byOwner := make(map[string][]string)
+	for _, key := range keys {
+		var addr string
+		if i < len(owners[key]) {
+			addr = owners[key][i]
+		}
+		byOwner[addr] = append(byOwner[addr], key)
+	}
+	return byOwner
+}
+
+// loadMultiFrom gets keys from addr, the owner at index i of their owners,
+// trying the next owners of any keys that it fails to return.
+func (c *Cache) loadMultiFrom(ctx context.Context, picker PeerPicker, peers peerMap, owners map[string][]string, i int, addr string, keys []string) (map[string]Result, KeyErrors) {
+	if addr == c.me {
+		results, errs := c.getLocalMulti(ctx, keys)
+		if i == 0 {
+			entries := make(map[string]Entry, len(results))
+			for key, res := range results {
+				entries[key] = Entry{Value: res.Value, TTL: res.TTL}
+			}
+			c.replicate(ctx, picker, peers, entries)
+		}
+		return results, errs
+	}
+
+	var results map[string]Result
+	var errs KeyErrors
+	var peerErr error
+	failed := keys
+	if peer, ok := peers.acquire(addr); ok {
+		if c.allowPeer(ctx, addr, peer) {
+			results, errs, failed, peerErr = c.getFromPeerMulti(ctx, addr, peer, keys)
+		} else {
+			peerErr = errPeerEjected
+		}
+		peer.release()
+		if len(failed) == 0 {
+			return results, errs
+		}
+	}
+	if results == nil {
+		results = make(map[string]Result, len(keys))
+	}
+
+	// Otherwise, try the next owner of the failed keys, falling back to
+	// getting them locally once there are none left.
+	for next, keys := range groupByOwner(failed, owners, i+1) {
+		var nextResults map[string]Result
+		var nextErrs KeyErrors
+		if next == "" {
+			c.observe(ctx, FallbackEvent{Peer: addr, Keys: keys, Err: peerErr})
+			nextResults, nextErrs = c.fallbackToLocalMulti(ctx, keys)
+		} else {
+			nextResults, nextErrs = c.loadMultiFrom(ctx, picker, peers, owners, i+1, next, keys)
+		}
+		for key, res := range nextResults {
+			results[key] = res
+		}
+		for key, err := range nextErrs {
+			errs = errs.add(key, err)
+		}
+	}
+	return results, errs
+}
+
+// getFromPeerMulti gets keys from peer, returning the keys that it failed to
+// return, along with the error from the request, if any.
+func (c *Cache) getFromPeerMulti(ctx context.Context, addr string, peer *peerHandle, keys []string) (map[string]Result, KeyErrors, []string, error) {
+	peerCtx, done := c.observePeer(ctx, addr, "GetMulti", keys...)
+	start := time.Now()
+	results, err := peer.GetMulti(peerCtx, keys)
+	done(err)
+	var keyErrs KeyErrors
+	if err != nil && !errors.As(err, &keyErrs) {
+		c.recordPeer(ctx, addr, peer, time.Since(start), err)
+		return nil, nil, keys, err
+	}
+	c.recordPeer(ctx, addr, peer, time.Since(start), nil)
+
+	if results == nil {
+		results = make(map[string]Result, len(keys))
+	}
+	var errs KeyErrors
+	var failed []string
+	for _, key := range keys {
+		if err := keyErrs[key]; err != nil && errors.Is(err, ErrNotFound) {
+			errs = errs.add(key, err)
+			continue
+		}
+		res, ok := results[key]
+		if !ok {
+			failed = append(failed, key)
+			continue
+		}
+		results[key] = c.fromPeer(ctx, key, res)
+	}
+	return results, errs, failed, err
+}
+
+func (c *Cache) getLocalMulti(ctx context.Context, keys []string) (map[string]Result, KeyErrors) {
+	entries, errs := c.getterGetMulti(ctx, keys)
+	c.cacheNotFoundMulti(ctx, StoreLocal, errs)
+	results := make(map[string]Result, len(entries))
+	for key, entry := range entries {
+		ttl := c.storeTTL(entry.TTL)
+		c.populateLocalStore(ctx, key, entry.Value, ttl)
+		results[key] = Result{Source: ResultLocalGet, Value: entry.Value, TTL: ttl}
+	}
+	return results, errs
+}
+
+func (c *Cache) fallbackToLocalMulti(ctx context.Context, keys []string) (map[string]Result, KeyErrors) {
+	entries, errs := c.getterGetMulti(ctx, keys)
+	c.cacheNotFoundMulti(ctx, StoreHot, errs)
+	results := make(map[string]Result, len(entries))
+	for key, entry := range entries {
+		ttl := c.storeTTL(entry.TTL)
+		c.populateHotStore(ctx, key, entry.Value, ttl)
+		results[key] = Result{Source: ResultLocalGet, Value: entry.Value, TTL: ttl}
+	}
+	return results, errs
+}
+
+func (c *Cache) cacheNotFoundMulti(ctx context.Context, kind StoreKind, errs KeyErrors) {
+	for key, err := range errs {
+		if errors.Is(err, ErrNotFound) {
+			c.cacheNotFound(ctx, kind, key)
+		}
+	}
+}
+
+// getterGetMulti gets the values for keys from the Getter, using a single call
+// if it's a BatchGetter.
+func (c *Cache) getterGetMulti(ctx context.Context, keys []string) (map[string]Entry, KeyErrors) {
+	if bg, ok := c.getter.(BatchGetter); ok {
+		getterCtx, done := c.observeGetter(ctx, keys...)
+		entries, err := bg.GetMulti(getterCtx, keys)
+		done(err)
+		var keyErrs KeyErrors
+		if err != nil && !errors.As(err, &keyErrs) {
+			var errs KeyErrors
+			for _, key := range keys {
+				errs = errs.add(key, err)
+			}
+			return nil, errs
+		}
+		if entries == nil {
+			entries = make(map[string]Entry, len(keys))
+		}
+		for _, key := range keys {
+			if _, ok := keyErrs[key]; ok {
+				delete(entries, key)
+				continue
+			}
+			if _, ok := entries[key]; !ok {
+				entries[key] = Entry{}
+			}
+		}
+		return entries, keyErrs
+	}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	var errs KeyErrors
+	entries := make(map[string]Entry, len(keys))
+	for _, key := range keys {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			val, ttl, err := c.getterGet(ctx, key)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				errs = errs.add(key, err)
+				return
+			}
+			entries[key] = Entry{Value: val, TTL: ttl}
+		}()
+	}
+	wg.Wait()
+	return entries, errs
+}
@@ -0,0 +1,66 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2020 Ryan Fowler
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package distcache
+
+import (
+	"context"
+	"errors"
+	"strings"
+)
+
+// ErrNotFound can be returned by a Getter when a key doesn't exist. If
+// Options.NotFoundTTL is set, the miss is cached so that the Getter isn't
+// called again for the key until it expires.
+var ErrNotFound = errors.New("key not found")
+
+// notFoundPrefix is prepended to keys to store cached misses alongside values,
+// without ambiguity about what the stored value represents.
+const notFoundPrefix = "\x00distcache:notfound:"
+
+func notFoundKey(key string) string {
+	return notFoundPrefix + key
+}
+
+// isNotFoundKey returns whether key is used to store a cached miss.
+func isNotFoundKey(key string) bool {
+	return strings.HasPrefix(key, notFoundPrefix)
+}
+
+func (c *Cache) isNotFound(ctx context.Context, key string) bool {
+	nfKey := notFoundKey(key)
+	for _, store := range []Store{c.hotStore, c.localStore} {
+		val, _, err := store.Get(ctx, nfKey)
+		if err == nil && val != nil {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *Cache) cacheNotFound(ctx context.Context, kind StoreKind, key string) {
+	if c.notFoundTTL <= 0 || c.deletions.deletedSince(ctx, key) {
+		return
+	}
+	// Errors are reported to the observer.
+	_ = c.storeSet(ctx, kind, notFoundKey(key), []byte{}, c.notFoundTTL)
+}
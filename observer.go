@@ -0,0 +1,297 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2020 Ryan Fowler
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package distcache
+
+import (
+	"context"
+	"time"
+)
+
+// Observer receives events from a Cache, allowing errors and the cache's
+// behaviour to be logged or monitored. Observe is called synchronously, so it
+// must be quick and safe for concurrent use.
+type Observer interface {
+	Observe(ctx context.Context, event Event)
+}
+
+type ObserverFunc func(ctx context.Context, event Event)
+
+func (of ObserverFunc) Observe(ctx context.Context, event Event) {
+	of(ctx, event)
+}
+
+// MultiObserver returns an Observer that passes events to each of observers.
+func MultiObserver(observers ...Observer) Observer {
+	return multiObserver(observers)
+}
+
+type multiObserver []Observer
+
+func (mo multiObserver) Observe(ctx context.Context, event Event) {
+	for _, o := range mo {
+		o.Observe(ctx, event)
+	}
+}
+
+// Event is one of the *Event types in this package.
+type Event interface {
+	isEvent()
+}
+
+type StoreKind int
+
+const (
+	StoreHot StoreKind = iota
+	StoreLocal
+)
+
+func (sk StoreKind) String() string {
+	switch sk {
+	case StoreHot:
+		return "hot"
+	case StoreLocal:
+		return "local"
+	default:
+		return "unknown"
+	}
+}
+
+type StoreOp int
+
+const (
+	StoreOpGet StoreOp = iota
+	StoreOpSet
+	StoreOpDelete
+)
+
+func (so StoreOp) String() string {
+	switch so {
+	case StoreOpGet:
+		return "get"
+	case StoreOpSet:
+		return "set"
+	case StoreOpDelete:
+		return "delete"
+	default:
+		return "unknown"
+	}
+}
+
+// GetEvent is emitted for every key requested from the cache. Shared is true
+// if the key was already being loaded by another caller.
+type GetEvent struct {
+	Key     string
+	Source  ResultSource
+	Shared  bool
+	Latency time.Duration
+	Err     error
+}
+
+// StoreEvent is emitted after every operation on the hot or local store.
+type StoreEvent struct {
+	Store StoreKind
+	Op    StoreOp
+	Key   string
+	// Hit is whether the key was found, for StoreOpGet.
+	Hit bool
+	Err error
+}
+
+// PeerRequestStartEvent is emitted before a request is made to a peer.
+// Method is one of "Get", "GetMulti" or "Delete".
+type PeerRequestStartEvent struct {
+	Peer   string
+	Method string
+	Keys   []string
+}
+
+// PeerRequestEvent is emitted after a request to a peer completes.
+type PeerRequestEvent struct {
+	Peer    string
+	Method  string
+	Keys    []string
+	Latency time.Duration
+	Err     error
+}
+
+// GetterEvent is emitted after every call to the Getter.
+type GetterEvent struct {
+	Keys    []string
+	Latency time.Duration
+	Err     error
+}
+
+// FallbackEvent is emitted when keys owned by a peer are retrieved using the
+// local Getter instead, either because the request to Peer failed with Err,
+// or because the owner isn't a known peer.
+type FallbackEvent struct {
+	Peer string
+	Keys []string
+	Err  error
+}
+
+// RefreshEvent is emitted after a background refresh of a stale value.
+type RefreshEvent struct {
+	Key string
+	Err error
+}
+
+// PeerAddedEvent is emitted when a peer is added by SetPeers.
+type PeerAddedEvent struct {
+	Peer string
+}
+
+// PeerRemovedEvent is emitted when a peer removed by SetPeers is closed, once
+// its in-flight requests finish, with the error from closing it, if any.
+type PeerRemovedEvent struct {
+	Peer string
+	Err  error
+}
+
+// HandoffEvent is emitted after sending entries to a peer that became their
+// owner.
+type HandoffEvent struct {
+	Peer  string
+	Keys  int
+	Bytes int
+	Err   error
+}
+
+// PeerHealthEvent is emitted when the health of a peer changes, with the
+// reason for the change.
+type PeerHealthEvent struct {
+	Peer   string
+	State  PeerState
+	Reason string
+}
+
+func (GetEvent) isEvent()              {}
+func (StoreEvent) isEvent()            {}
+func (PeerRequestStartEvent) isEvent() {}
+func (PeerRequestEvent) isEvent()      {}
+func (GetterEvent) isEvent()           {}
+func (FallbackEvent) isEvent()         {}
+func (RefreshEvent) isEvent()          {}
+func (PeerAddedEvent) isEvent()        {}
+func (PeerRemovedEvent) isEvent()      {}
+func (HandoffEvent) isEvent()          {}
+func (PeerHealthEvent) isEvent()       {}
+
+func (c *Cache) observe(ctx context.Context, event Event) {
+	if c.observer != nil {
+		c.observer.Observe(ctx, event)
+	}
+}
+
+func (c *Cache) store(kind StoreKind) Store {
+	if kind == StoreHot {
+		return c.hotStore
+	}
+	return c.localStore
+}
+
+func (c *Cache) storeGet(ctx context.Context, kind StoreKind, key string) ([]byte, time.Duration, error) {
+	ctx, span := c.startSpan(ctx, "distcache.Store.Get", key)
+	val, ttl, err := c.store(kind).Get(ctx, key)
+	if c.tracer != nil {
+		span.SetAttributes(Attribute{Key: AttrStore, Value: kind.String()})
+	}
+	endSpan(span, err)
+	if c.observer != nil {
+		c.observer.Observe(ctx, StoreEvent{
+			Store: kind,
+			Op:    StoreOpGet,
+			Key:   key,
+			Hit:   err == nil && val != nil,
+			Err:   err,
+		})
+	}
+	return val, ttl, err
+}
+
+func (c *Cache) storeSet(ctx context.Context, kind StoreKind, key string, val []byte, ttl time.Duration) error {
+	err := c.store(kind).Set(ctx, key, val, ttl)
+	if c.observer != nil {
+		c.observer.Observe(ctx, StoreEvent{Store: kind, Op: StoreOpSet, Key: key, Err: err})
+	}
+	return err
+}
+
+func (c *Cache) storeDelete(ctx context.Context, kind StoreKind, key string) error {
+	err := c.store(kind).Delete(ctx, key)
+	if c.observer != nil {
+		c.observer.Observe(ctx, StoreEvent{Store: kind, Op: StoreOpDelete, Key: key, Err: err})
+	}
+	return err
+}
+
+// observePeer starts a span and emits a PeerRequestStartEvent for a request
+// to a peer, returning a function that ends the span and emits the
+// corresponding PeerRequestEvent.
+func (c *Cache) observePeer(ctx context.Context, addr, method string, keys ...string) (context.Context, func(error)) {
+	ctx, span := c.startSpan(ctx, "distcache.Peer."+method, keys...)
+	if c.tracer != nil {
+		span.SetAttributes(Attribute{Key: AttrPeer, Value: addr})
+	}
+	if c.observer == nil {
+		return ctx, func(err error) { endSpan(span, err) }
+	}
+	c.observer.Observe(ctx, PeerRequestStartEvent{Peer: addr, Method: method, Keys: keys})
+	start := time.Now()
+	return ctx, func(err error) {
+		endSpan(span, err)
+		c.observer.Observe(ctx, PeerRequestEvent{
+			Peer:    addr,
+			Method:  method,
+			Keys:    keys,
+			Latency: time.Since(start),
+			Err:     err,
+		})
+	}
+}
+
+// observeGetter starts a span for a call to the Getter, returning a function
+// that ends it and emits a GetterEvent.
+func (c *Cache) observeGetter(ctx context.Context, keys ...string) (context.Context, func(error)) {
+	ctx, span := c.startSpan(ctx, "distcache.Getter.Get", keys...)
+	if c.observer == nil {
+		return ctx, func(err error) { endSpan(span, err) }
+	}
+	start := time.Now()
+	return ctx, func(err error) {
+		endSpan(span, err)
+		c.observer.Observe(ctx, GetterEvent{Keys: keys, Latency: time.Since(start), Err: err})
+	}
+}
+
+func (c *Cache) observeGet(ctx context.Context, key string, res Result, shared bool, start time.Time, err error) {
+	if c.observer != nil {
+		c.observer.Observe(ctx, GetEvent{
+			Key:     key,
+			Source:  res.Source,
+			Shared:  shared,
+			Latency: time.Since(start),
+			Err:     err,
+		})
+	}
+}
@@ -0,0 +1,443 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2020 Ryan Fowler
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package distcache
+
+import (
+	"hash/crc32"
+	"hash/fnv"
+	"math"
+	"slices"
+	"sort"
+	"strconv"
+)
+
+// PeerPicker chooses the peer that owns each key.
+type PeerPicker interface {
+	// PickPeer returns the address of the peer that owns key, or an empty
+	// string if there are no peers.
+	PickPeer(key string) string
+	// PickPeers returns the addresses of up to n distinct peers that own
+	// key, in order of preference, starting with the peer returned by
+	// PickPeer.
+	PickPeers(key string, n int) []string
+}
+
+// Picker creates a PeerPicker for a set of peers. Every node in a cluster
+// must use the same Picker, so that they agree on the owner of each key.
+type Picker func(peers ...PeerInfo) PeerPicker
+
+// PeerInfo describes a peer, along with its share of the keyspace relative to
+// other peers.
+type PeerInfo struct {
+	Addr string
+	// Weight is the relative number of keys that the peer owns. Zero is
+	// treated as a weight of 1.
+	Weight float64
+}
+
+func (p PeerInfo) weight() float64 {
+	if p.Weight <= 0 {
+		return 1
+	}
+	return p.Weight
+}
+
+func peerInfos(addrs []string) []PeerInfo {
+	peers := make([]PeerInfo, len(addrs))
+	for i, addr := range addrs {
+		peers[i] = PeerInfo{Addr: addr}
+	}
+	return peers
+}
+
+// sortedPeers returns a sorted copy of peers, without duplicate addresses.
+func sortedPeers(peers []PeerInfo) []PeerInfo {
+	out := make([]PeerInfo, 0, len(peers))
+	seen := make(map[string]struct{}, len(peers))
+	for _, peer := range peers {
+		if _, ok := seen[peer.Addr]; !ok {
+			seen[peer.Addr] = struct{}{}
+			out = append(out, peer)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Addr < out[j].Addr })
+	return out
+}
+
+// HashFunc hashes a byte slice to a 64-bit value.
+type HashFunc func([]byte) uint64
+
+// CRC32 is a HashFunc using the IEEE CRC-32 checksum.
+func CRC32(b []byte) uint64 {
+	return uint64(crc32.ChecksumIEEE(b))
+}
+
+// FNV1a is a HashFunc using the 64-bit FNV-1a hash, with its output mixed so
+// that similar inputs produce dissimilar hashes.
+func FNV1a(b []byte) uint64 {
+	h := fnv.New64a()
+	_, _ = h.Write(b)
+	return mix64(h.Sum64())
+}
+
+// mix64 is the finalizer from splitmix64.
+func mix64(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
+
+// defaultPicker is the Picker used when none is provided. It must remain
+// unchanged so that nodes running different versions agree on key owners.
+var defaultPicker = Ring(32, CRC32)
+
+// Ring returns a Picker that places vnodes virtual nodes per unit of weight
+// for each peer on a consistent hash ring. Changing a peer's weight only adds
+// or removes its own virtual nodes. If hash is nil, CRC32 is used.
+func Ring(vnodes int, hash HashFunc) Picker {
+	if vnodes <= 0 {
+		vnodes = 32
+	}
+	if hash == nil {
+		hash = CRC32
+	}
+	return func(peers ...PeerInfo) PeerPicker {
+		return newRing(vnodes, hash, peers)
+	}
+}
+
+type ring struct {
+	hash   HashFunc
+	hashes []uint64
+	peers  map[uint64]string
+}
+
+func newRing(vnodes int, hash HashFunc, peers []PeerInfo) *ring {
+	r := &ring{
+		hash:   hash,
+		hashes: make([]uint64, 0, vnodes*len(peers)),
+		peers:  make(map[uint64]string, vnodes*len(peers)),
+	}
+	for _, peer := range peers {
+		n := max(1, int(math.Round(float64(vnodes)*peer.weight())))
+		for i := 0; i < n; i++ {
+			h := hash([]byte(strconv.Itoa(i) + "_" + peer.Addr))
+			if _, ok := r.peers[h]; !ok {
+				r.hashes = append(r.hashes, h)
+			}
+			r.peers[h] = peer.Addr
+		}
+	}
+	sort.Slice(r.hashes, func(i, j int) bool { return r.hashes[i] < r.hashes[j] })
+	return r
+}
+
+func (r *ring) PickPeer(key string) string {
+	if len(r.hashes) == 0 {
+		return ""
+	}
+	return r.peers[r.hashes[r.search(r.hash([]byte(key)))]]
+}
+
+func (r *ring) PickPeers(key string, n int) []string {
+	if len(r.hashes) == 0 {
+		return nil
+	}
+	return r.walk(r.search(r.hash([]byte(key))), n)
+}
+
+// walk returns up to n distinct peers clockwise from the virtual node at idx.
+func (r *ring) walk(idx, n int) []string {
+	var owners []string
+	for i := 0; i < len(r.hashes) && len(owners) < n; i++ {
+		peer := r.peers[r.hashes[(idx+i)%len(r.hashes)]]
+		if !slices.Contains(owners, peer) {
+			owners = append(owners, peer)
+		}
+	}
+	return owners
+}
+
+// search returns the index of the first virtual node at or after h.
+func (r *ring) search(h uint64) int {
+	idx := sort.Search(len(r.hashes), func(i int) bool { return r.hashes[i] >= h })
+	if idx >= len(r.hashes) {
+		idx = 0
+	}
+	return idx
+}
+
+// Rendezvous returns a Picker using weighted rendezvous, or highest random
+// weight, hashing. Each key is owned by the peer with the highest score for
+// it, so only the keys of added, removed or reweighted peers move. If hash is
+// nil, FNV1a is used.
+func Rendezvous(hash HashFunc) Picker {
+	if hash == nil {
+		hash = FNV1a
+	}
+	return func(peers ...PeerInfo) PeerPicker {
+		r := &rendezvous{hash: hash, peers: sortedPeers(peers)}
+		r.hashes = make([]uint64, len(r.peers))
+		for i, peer := range r.peers {
+			r.hashes[i] = hash([]byte(peer.Addr))
+		}
+		return r
+	}
+}
+
+type rendezvous struct {
+	hash   HashFunc
+	peers  []PeerInfo
+	hashes []uint64
+}
+
+func (r *rendezvous) PickPeer(key string) string {
+	kh := r.hash([]byte(key))
+	var owner string
+	var best float64
+	for i, ph := range r.hashes {
+		// Peers are sorted, so ties are broken consistently.
+		if score := r.score(kh^ph, r.peers[i].weight()); owner == "" || score > best {
+			owner, best = r.peers[i].Addr, score
+		}
+	}
+	return owner
+}
+
+func (r *rendezvous) PickPeers(key string, n int) []string {
+	if n <= 1 {
+		return pickOne(r.PickPeer(key))
+	}
+	kh := r.hash([]byte(key))
+	scores := make([]float64, len(r.peers))
+	order := make([]int, len(r.peers))
+	for i, ph := range r.hashes {
+		scores[i] = r.score(kh^ph, r.peers[i].weight())
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool { return scores[order[i]] > scores[order[j]] })
+	owners := make([]string, 0, min(n, len(order)))
+	for _, i := range order[:min(n, len(order))] {
+		owners = append(owners, r.peers[i].Addr)
+	}
+	return owners
+}
+
+// score maps the combined hash of a key and peer to (0, 1), and scores it so
+// that each peer wins in proportion to its weight.
+func (r *rendezvous) score(h uint64, weight float64) float64 {
+	u := (float64(mix64(h)>>11) + 0.5) / (1 << 53)
+	return -weight / math.Log(u)
+}
+
+// JumpHash returns a Picker using jump consistent hashing. It's fast and
+// evenly balanced, but peers are numbered in sorted order, so keys only move
+// minimally when peers are added or removed at the end of that order, such as
+// with ordinal hostnames. Weights are ignored. If hash is nil, FNV1a is used.
+func JumpHash(hash HashFunc) Picker {
+	if hash == nil {
+		hash = FNV1a
+	}
+	return func(peers ...PeerInfo) PeerPicker {
+		j := &jump{hash: hash}
+		for _, peer := range sortedPeers(peers) {
+			j.peers = append(j.peers, peer.Addr)
+		}
+		return j
+	}
+}
+
+type jump struct {
+	hash  HashFunc
+	peers []string
+}
+
+func (j *jump) PickPeer(key string) string {
+	if len(j.peers) == 0 {
+		return ""
+	}
+	return j.peers[jumpHash(j.hash([]byte(key)), len(j.peers))]
+}
+
+// PickPeers returns the peer chosen by PickPeer, followed by the peers after
+// it in sorted order.
+func (j *jump) PickPeers(key string, n int) []string {
+	if len(j.peers) == 0 {
+		return nil
+	}
+	idx := jumpHash(j.hash([]byte(key)), len(j.peers))
+	owners := make([]string, 0, min(n, len(j.peers)))
+	for i := 0; i < cap(owners); i++ {
+		owners = append(owners, j.peers[(idx+i)%len(j.peers)])
+	}
+	return owners
+}
+
+// jumpHash is the algorithm from "A Fast, Minimal Memory, Consistent Hash
+// Algorithm" by Lamping and Veach.
+func jumpHash(key uint64, buckets int) int {
+	var b, j int64 = -1, 0
+	for j < int64(buckets) {
+		b = j
+		key = key*2862933555777941757 + 1
+		j = int64(float64(b+1) * (float64(int64(1)<<31) / float64((key>>33)+1)))
+	}
+	return int(b)
+}
+
+// BoundedLoad returns a Picker using consistent hashing with bounded loads.
+// Keys are hashed into a fixed number of partitions, and each partition is
+// assigned to the first peer clockwise from it on a weighted ring that owns
+// fewer than load times its fair share of partitions. This caps the share of
+// any one peer at roughly load times its weighted share, at the cost of moving
+// a few more keys when peers change. If partitions is zero, 1024 is used; if
+// load is less than 1, 1.25 is used; if hash is nil, FNV1a is used.
+func BoundedLoad(partitions int, load float64, hash HashFunc) Picker {
+	if partitions <= 0 {
+		partitions = 1024
+	}
+	if load < 1 {
+		load = 1.25
+	}
+	if hash == nil {
+		hash = FNV1a
+	}
+	return func(peers ...PeerInfo) PeerPicker {
+		b := &boundedLoad{hash: hash}
+		peers = sortedPeers(peers)
+		if len(peers) == 0 {
+			return b
+		}
+		var total float64
+		for _, peer := range peers {
+			total += peer.weight()
+		}
+		limits := make(map[string]int, len(peers))
+		for _, peer := range peers {
+			limits[peer.Addr] = int(math.Ceil(load * float64(partitions) * peer.weight() / total))
+		}
+		r := newRing(32, hash, peers)
+		b.ring = r
+		b.owners = make([]string, partitions)
+		for p := range b.owners {
+			idx := r.search(hash([]byte(strconv.Itoa(p))))
+			for {
+				peer := r.peers[r.hashes[idx]]
+				if limits[peer] > 0 {
+					limits[peer]--
+					b.owners[p] = peer
+					break
+				}
+				idx = (idx + 1) % len(r.hashes)
+			}
+		}
+		return b
+	}
+}
+
+type boundedLoad struct {
+	hash   HashFunc
+	ring   *ring
+	owners []string
+}
+
+func (b *boundedLoad) PickPeer(key string) string {
+	if len(b.owners) == 0 {
+		return ""
+	}
+	return b.owners[b.hash([]byte(key))%uint64(len(b.owners))]
+}
+
+// PickPeers returns the owner of the key's partition, followed by the other
+// peers clockwise from the partition on the ring, regardless of their load.
+func (b *boundedLoad) PickPeers(key string, n int) []string {
+	if len(b.owners) == 0 {
+		return nil
+	}
+	p := b.hash([]byte(key)) % uint64(len(b.owners))
+	owners := []string{b.owners[p]}
+	if n <= 1 {
+		return owners
+	}
+	for _, peer := range b.ring.walk(b.ring.search(b.hash([]byte(strconv.FormatUint(p, 10)))), n+1) {
+		if peer != owners[0] && len(owners) < n {
+			owners = append(owners, peer)
+		}
+	}
+	return owners
+}
+
+func pickOne(peer string) []string {
+	if peer == "" {
+		return nil
+	}
+	return []string{peer}
+}
+
+// Movement is the fraction of the keyspace that moves from one peer to
+// another.
+type Movement struct {
+	From     string
+	To       string
+	Fraction float64
+}
+
+// EstimateMovement estimates the fraction of the keyspace that moves between
+// each pair of peers when the peers change from oldPeers to newPeers. It's a
+// sampled estimate from picking peers for a fixed set of keys, not an exact
+// calculation from the pickers' partitions, so small fractions may be missed.
+// If either list is empty, keys move from or to an empty address. If picker is
+// nil, the default Picker is used.
+func EstimateMovement(picker Picker, oldPeers, newPeers []PeerInfo) []Movement {
+	const samples = 1 << 16
+	if picker == nil {
+		picker = defaultPicker
+	}
+	before, after := picker(oldPeers...), picker(newPeers...)
+
+	type move struct{ from, to string }
+	counts := make(map[move]int)
+	var buf []byte
+	for i := 0; i < samples; i++ {
+		buf = strconv.AppendInt(append(buf[:0], "distcache_sample_"...), int64(i), 10)
+		from, to := before.PickPeer(string(buf)), after.PickPeer(string(buf))
+		if from != to {
+			counts[move{from, to}]++
+		}
+	}
+
+	moves := make([]Movement, 0, len(counts))
+	for m, n := range counts {
+		moves = append(moves, Movement{From: m.from, To: m.to, Fraction: float64(n) / samples})
+	}
+	sort.Slice(moves, func(i, j int) bool {
+		if moves[i].From != moves[j].From {
+			return moves[i].From < moves[j].From
+		}
+		return moves[i].To < moves[j].To
+	})
+	return moves
+}
@@ -0,0 +1,214 @@
+package distcache_test
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/ryanfowler/distcache"
+	"github.com/ryanfowler/distcache/lru"
+)
+
+func TestPickers(t *testing.T) {
+	pickers := []struct {
+		name    string
+		picker  distcache.Picker
+		maxSkew float64
+		minimal bool
+	}{
+		{"ring", distcache.Ring(32, distcache.CRC32), 2, true},
+		{"ring_fnv_256", distcache.Ring(256, distcache.FNV1a), 1.3, true},
+		{"rendezvous", distcache.Rendezvous(nil), 1.1, true},
+		{"jump", distcache.JumpHash(nil), 1.1, true},
+		{"bounded_load", distcache.BoundedLoad(0, 1.1, nil), 1.15, false},
+	}
+
+	const numKeys = 100000
+	keys := make([]string, numKeys)
+	for i := range keys {
+		keys[i] = "key" + strconv.Itoa(i)
+	}
+	peers := testPeers(6)
+
+	for _, test := range pickers {
+		t.Run(test.name, func(t *testing.T) {
+			before := pickAll(test.picker(peers[:5]...), keys)
+			skew := distributionSkew(before, 5)
+			if skew > test.maxSkew {
+				t.Errorf("distribution skew %.3f exceeds %.3f", skew, test.maxSkew)
+			}
+
+			added := pickAll(test.picker(peers...), keys)
+			movedOnAdd := movement(t, before, added, peers[5].Addr, test.minimal)
+
+			removed := pickAll(test.picker(peers[:4]...), keys)
+			movedOnRemove := movement(t, before, removed, peers[4].Addr, test.minimal)
+
+			t.Logf("skew=%.3f moved_on_add=%.3f moved_on_remove=%.3f", skew, movedOnAdd, movedOnRemove)
+			if movedOnAdd > 0.5 || movedOnRemove > 0.5 {
+				t.Errorf("too many keys moved")
+			}
+		})
+	}
+
+	for _, test := range pickers {
+		picker := test.picker(peers...)
+		for _, key := range keys[:1000] {
+			owners := picker.PickPeers(key, 3)
+			if len(owners) != 3 || owners[0] != picker.PickPeer(key) {
+				t.Fatalf("%s: unexpected owners for key %q: %v", test.name, key, owners)
+			}
+			if owners[0] == owners[1] || owners[0] == owners[2] || owners[1] == owners[2] {
+				t.Fatalf("%s: duplicate owners for key %q: %v", test.name, key, owners)
+			}
+		}
+		if owners := picker.PickPeers("key", 10); len(owners) != len(peers) {
+			t.Fatalf("%s: unexpected owners: %v", test.name, owners)
+		}
+	}
+
+	for _, test := range pickers {
+		if p := test.picker().PickPeer("key"); p != "" {
+			t.Errorf("%s: unexpected peer with no peers: %q", test.name, p)
+		}
+	}
+}
+
+func TestWeightedPickers(t *testing.T) {
+	pickers := []struct {
+		name    string
+		picker  distcache.Picker
+		minimal bool
+	}{
+		{"ring", distcache.Ring(256, distcache.FNV1a), true},
+		{"rendezvous", distcache.Rendezvous(nil), true},
+		{"bounded_load", distcache.BoundedLoad(0, 1.1, nil), false},
+	}
+
+	keys := make([]string, 100000)
+	for i := range keys {
+		keys[i] = "key" + strconv.Itoa(i)
+	}
+	peers := testPeers(4)
+	heavy := peers[0].Addr
+
+	for _, test := range pickers {
+		t.Run(test.name, func(t *testing.T) {
+			peers[0].Weight = 2
+			before := pickAll(test.picker(peers...), keys)
+			share := keyShare(before, heavy)
+			if share < 0.35 || share > 0.45 {
+				t.Errorf("unexpected share for peer with weight 2: %.3f", share)
+			}
+
+			peers[0].Weight = 3
+			after := pickAll(test.picker(peers...), keys)
+			moved := movement(t, before, after, heavy, test.minimal)
+			t.Logf("share=%.3f moved_on_reweight=%.3f", share, moved)
+			if moved > 0.25 {
+				t.Errorf("too many keys moved: %.3f", moved)
+			}
+		})
+	}
+}
+
+func testPeers(n int) []distcache.PeerInfo {
+	peers := make([]distcache.PeerInfo, n)
+	for i := range peers {
+		peers[i] = distcache.PeerInfo{Addr: "10.0.0." + strconv.Itoa(i) + ":8080"}
+	}
+	return peers
+}
+
+func keyShare(owners map[string]string, peer string) float64 {
+	var n int
+	for _, owner := range owners {
+		if owner == peer {
+			n++
+		}
+	}
+	return float64(n) / float64(len(owners))
+}
+
+func pickAll(picker distcache.PeerPicker, keys []string) map[string]string {
+	owners := make(map[string]string, len(keys))
+	for _, key := range keys {
+		owners[key] = picker.PickPeer(key)
+	}
+	return owners
+}
+
+// distributionSkew returns the ratio of the most loaded peer's keys to the
+// average number of keys per peer.
+func distributionSkew(owners map[string]string, numPeers int) float64 {
+	counts := make(map[string]int)
+	for _, peer := range owners {
+		counts[peer]++
+	}
+	var most int
+	for _, n := range counts {
+		most = max(most, n)
+	}
+	return float64(most) / (float64(len(owners)) / float64(numPeers))
+}
+
+// movement returns the fraction of keys whose owner changed. If minimal is
+// set, it also checks that keys only moved to or from peer.
+func movement(t *testing.T, before, after map[string]string, peer string, minimal bool) float64 {
+	t.Helper()
+	var moved int
+	for key, owner := range before {
+		if after[key] == owner {
+			continue
+		}
+		moved++
+		if minimal && owner != peer && after[key] != peer {
+			t.Errorf("key %q moved from %s to %s", key, owner, after[key])
+			return 0
+		}
+	}
+	return float64(moved) / float64(len(before))
+}
+
+func TestEstimateMovement(t *testing.T) {
+	oldPeers, newPeers := testPeers(12), testPeers(15)
+	moves := distcache.EstimateMovement(nil, oldPeers, newPeers)
+
+	var total float64
+	for _, m := range moves {
+		if m.To != newPeers[12].Addr && m.To != newPeers[13].Addr && m.To != newPeers[14].Addr {
+			t.Fatalf("unexpected movement to existing peer: %+v", m)
+		}
+		total += m.Fraction
+	}
+	if total < 0.1 || total > 0.3 {
+		t.Fatalf("unexpected fraction of keys moved: %.3f", total)
+	}
+
+	if moves := distcache.EstimateMovement(nil, oldPeers, oldPeers); len(moves) != 0 {
+		t.Fatalf("unexpected movement without changes: %+v", moves)
+	}
+}
+
+func TestOwner(t *testing.T) {
+	peers := testPeers(3)
+	cache := distcache.New(distcache.Options{
+		Me:          peers[0].Addr,
+		HotStore:    lru.New(1 << 20),
+		LocalStore:  lru.New(1 << 20),
+		Getter:      keyGetter(),
+		PeerCreator: newMockPeers(),
+		PeerInfos:   peers,
+		Picker:      distcache.Rendezvous(nil),
+	})
+
+	if got := cache.Peers(); len(got) != 3 || got[1] != peers[1] {
+		t.Fatalf("unexpected peers: %+v", got)
+	}
+	picker := distcache.Rendezvous(nil)(peers...)
+	for i := 0; i < 100; i++ {
+		key := strconv.Itoa(i)
+		if owner := cache.Owner(key); owner != picker.PickPeer(key) {
+			t.Fatalf("unexpected owner for key %q: %s", key, owner)
+		}
+	}
+}
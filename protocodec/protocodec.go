@@ -20,45 +20,29 @@
 // OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
 // SOFTWARE.
 
-package distcache
+// Package protocodec provides a distcache.Codec for protobuf messages. It's
+// separate from distcache so that only users of it depend on protobuf.
+package protocodec
 
 import (
-	"hash/crc32"
-	"sort"
-	"strconv"
+	"github.com/ryanfowler/distcache"
+	"google.golang.org/protobuf/proto"
 )
 
-type peerHash struct {
-	hash   func([]byte) int
-	hashes []int
-	peers  map[int]string
+// New returns a Codec for protobuf messages, such as *pb.Message.
+func New[T proto.Message]() distcache.Codec[T] {
+	return codec[T]{}
 }
 
-func newPeerHash(peers ...string) *peerHash {
-	const vNodes = 32
-	h := &peerHash{
-		hash:   func(b []byte) int { return int(crc32.ChecksumIEEE(b)) },
-		hashes: make([]int, 0, vNodes*len(peers)),
-		peers:  make(map[int]string),
-	}
-	for _, peer := range peers {
-		for i := 0; i < vNodes; i++ {
-			hash := h.hash([]byte(strconv.Itoa(i) + "_" + peer))
-			h.hashes = append(h.hashes, hash)
-			h.peers[hash] = peer
-		}
-	}
-	sort.Ints(h.hashes)
-	return h
+type codec[T proto.Message] struct{}
+
+func (codec[T]) Marshal(v T) ([]byte, error) {
+	return proto.Marshal(v)
 }
 
-func (h *peerHash) GetPeer(key []byte) string {
-	if len(h.hashes) == 0 {
-		return ""
-	}
-	idx := sort.SearchInts(h.hashes, h.hash(key))
-	if idx >= len(h.hashes) {
-		idx = 0
-	}
-	return h.peers[h.hashes[idx]]
+func (codec[T]) Unmarshal(data []byte) (T, error) {
+	var zero T
+	v := zero.ProtoReflect().New().Interface().(T)
+	err := proto.Unmarshal(data, v)
+	return v, err
 }
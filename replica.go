@@ -0,0 +1,109 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2020 Ryan Fowler
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package distcache
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"time"
+)
+
+// replicateTimeout limits how long pushing values to replicas can take.
+const replicateTimeout = 10 * time.Second
+
+// ReplicaPeer is a Peer that can receive values loaded by the primary owner
+// of keys that it replicates.
+type ReplicaPeer interface {
+	Peer
+	Replicate(ctx context.Context, entries map[string]Entry) error
+}
+
+// owners returns the peers that own key, in order of preference.
+func (c *Cache) owners(picker PeerPicker, key string) []string {
+	return picker.PickPeers(key, max(1, c.replicas))
+}
+
+// Replicate stores values pushed by the primary owner of keys, replacing any
+// existing values. Entries for keys that this node doesn't own are ignored.
+func (c *Cache) Replicate(ctx context.Context, entries map[string]Entry) error {
+	c.mu.Lock()
+	picker := c.picker
+	c.mu.Unlock()
+
+	var errs []error
+	for key, entry := range entries {
+		if isNotFoundKey(key) || !slices.Contains(c.owners(picker, key), c.me) {
+			continue
+		}
+		if err := c.storeSet(ctx, StoreLocal, key, entry.Value, entry.TTL); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// replicate pushes values loaded by this node, as the primary owner, to the
+// other owners of their keys in the background. Values for keys deleted since
+// the load started aren't pushed.
+func (c *Cache) replicate(ctx context.Context, picker PeerPicker, peers peerMap, entries map[string]Entry) {
+	if c.replicas <= 1 || len(entries) == 0 {
+		return
+	}
+	byReplica := make(map[string]map[string]Entry)
+	for key, entry := range entries {
+		if c.deletions.deletedSince(ctx, key) {
+			continue
+		}
+		for _, addr := range c.owners(picker, key)[1:] {
+			if byReplica[addr] == nil {
+				byReplica[addr] = make(map[string]Entry)
+			}
+			byReplica[addr][key] = entry
+		}
+	}
+
+	ctx = context.WithoutCancel(ctx)
+	for addr, entries := range byReplica {
+		peer, ok := peers.acquire(addr)
+		if !ok {
+			continue
+		}
+		replica, ok := peer.Peer.(ReplicaPeer)
+		if !ok {
+			peer.release()
+			continue
+		}
+		go func() {
+			defer peer.release()
+			ctx, cancel := context.WithTimeout(ctx, replicateTimeout)
+			defer cancel()
+			keys := make([]string, 0, len(entries))
+			for key := range entries {
+				keys = append(keys, key)
+			}
+			ctx, done := c.observePeer(ctx, addr, "Replicate", keys...)
+			done(replica.Replicate(ctx, entries))
+		}()
+	}
+}
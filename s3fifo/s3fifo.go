@@ -0,0 +1,289 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2020 Ryan Fowler
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+// Package s3fifo implements a byte-budgeted store using the S3-FIFO eviction
+// policy.
+package s3fifo
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"time"
+
+	"github.com/ryanfowler/distcache"
+)
+
+var _ distcache.Store = (*S3FIFO)(nil)
+
+const (
+	// smallPercent is the share of the budget used by the small queue.
+	smallPercent = 10
+	// maxFreq is the maximum access count tracked for each value.
+	maxFreq = 3
+)
+
+type queue int
+
+const (
+	small queue = iota
+	main
+)
+
+// S3FIFO is a store that admits new values to a small FIFO queue, and only
+// moves them to the main FIFO queue if they are accessed again before
+// reaching its tail. Keys evicted from the small queue are remembered in a
+// ghost queue, so they go straight to the main queue if they're set again.
+// Values in the main queue are reinserted rather than evicted while they have
+// been accessed since they were last considered.
+type S3FIFO struct {
+	maxBytes   int
+	smallBytes int
+	now        func() time.Time
+
+	mu         sync.Mutex
+	queues     [2]*list.List
+	sizes      [2]int
+	evictions  uint64
+	values     map[string]*value
+	ghosts     *list.List
+	ghostSize  int
+	ghostIndex map[string]*list.Element
+}
+
+type value struct {
+	key     string
+	val     []byte
+	expires time.Time
+	freq    int
+	queue   queue
+	elem    *list.Element
+}
+
+func (v *value) size() int {
+	return len(v.key) + len(v.val)
+}
+
+func (v *value) expired(now time.Time) bool {
+	return !v.expires.IsZero() && !now.Before(v.expires)
+}
+
+type ghost struct {
+	key  string
+	size int
+}
+
+// New returns an S3FIFO that holds up to maxBytes of keys and values.
+func New(maxBytes int) *S3FIFO {
+	return &S3FIFO{
+		maxBytes:   maxBytes,
+		smallBytes: maxBytes * smallPercent / 100,
+		now:        time.Now,
+		queues:     [2]*list.List{list.New(), list.New()},
+		values:     make(map[string]*value),
+		ghosts:     list.New(),
+		ghostIndex: make(map[string]*list.Element),
+	}
+}
+
+func (s *S3FIFO) Get(ctx context.Context, key string) ([]byte, time.Duration, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	v, ok := s.values[key]
+	if !ok {
+		return nil, 0, nil
+	}
+	var ttl time.Duration
+	if !v.expires.IsZero() {
+		now := s.now()
+		if v.expired(now) {
+			s.remove(v)
+			return nil, 0, nil
+		}
+		ttl = v.expires.Sub(now)
+	}
+	v.freq = min(v.freq+1, maxFreq)
+	return v.val, ttl, nil
+}
+
+func (s *S3FIFO) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.values)
+}
+
+func (s *S3FIFO) Size() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.sizes[small] + s.sizes[main]
+}
+
+// Evictions returns the number of values that have been evicted to stay
+// within maxBytes.
+func (s *S3FIFO) Evictions() uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.evictions
+}
+
+// Range calls fn for each value, from the newest in the main queue to the
+// oldest in the small queue.
+func (s *S3FIFO) Range(fn func(key string, val []byte) bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.now()
+	for _, q := range []queue{main, small} {
+		for e := s.queues[q].Front(); e != nil; e = e.Next() {
+			v := e.Value.(*value)
+			if v.expired(now) {
+				continue
+			}
+			if !fn(v.key, v.val) {
+				return
+			}
+		}
+	}
+}
+
+func (s *S3FIFO) Set(ctx context.Context, key string, val []byte, ttl time.Duration) error {
+	if val == nil {
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	v, ok := s.values[key]
+	if ttl < 0 || len(key)+len(val) > s.maxBytes {
+		// The value has already expired, or can never fit.
+		if ok {
+			s.remove(v)
+		}
+		return nil
+	}
+
+	var expires time.Time
+	if ttl > 0 {
+		expires = s.now().Add(ttl)
+	}
+
+	if ok {
+		s.sizes[v.queue] += len(val) - len(v.val)
+		v.val = val
+		v.expires = expires
+		v.freq = min(v.freq+1, maxFreq)
+	} else {
+		v = &value{key: key, val: val, expires: expires}
+		q := small
+		if e, ok := s.ghostIndex[key]; ok {
+			s.removeGhost(e)
+			q = main
+		}
+		s.push(v, q)
+		s.values[key] = v
+	}
+
+	s.evict()
+	return nil
+}
+
+func (s *S3FIFO) Delete(ctx context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if v, ok := s.values[key]; ok {
+		s.remove(v)
+	}
+	return nil
+}
+
+func (s *S3FIFO) evict() {
+	for s.sizes[small]+s.sizes[main] > s.maxBytes {
+		if s.sizes[small] > s.smallBytes || s.queues[main].Len() == 0 {
+			s.evictSmall()
+		} else {
+			s.evictMain()
+		}
+	}
+}
+
+// evictSmall moves the oldest value in the small queue to the main queue if
+// it has been accessed since it was inserted, and otherwise evicts it to the
+// ghost queue.
+func (s *S3FIFO) evictSmall() {
+	v := s.queues[small].Back().Value.(*value)
+	s.unlink(v)
+	if v.freq > 0 {
+		v.freq = 0
+		s.push(v, main)
+		return
+	}
+	delete(s.values, v.key)
+	s.evictions++
+	s.addGhost(v)
+}
+
+// evictMain evicts the oldest value in the main queue, reinserting values
+// that have been accessed since they were last considered.
+func (s *S3FIFO) evictMain() {
+	for {
+		v := s.queues[main].Back().Value.(*value)
+		if v.freq == 0 {
+			s.remove(v)
+			s.evictions++
+			return
+		}
+		v.freq--
+		s.queues[main].MoveToFront(v.elem)
+	}
+}
+
+// addGhost remembers the key of an evicted value, forgetting the oldest keys
+// once the values they stood for would exceed the main queue's budget.
+func (s *S3FIFO) addGhost(v *value) {
+	s.ghostIndex[v.key] = s.ghosts.PushFront(ghost{key: v.key, size: v.size()})
+	s.ghostSize += v.size()
+	for s.ghostSize > s.maxBytes-s.smallBytes {
+		s.removeGhost(s.ghosts.Back())
+	}
+}
+
+func (s *S3FIFO) removeGhost(e *list.Element) {
+	g := s.ghosts.Remove(e).(ghost)
+	s.ghostSize -= g.size
+	delete(s.ghostIndex, g.key)
+}
+
+func (s *S3FIFO) push(v *value, q queue) {
+	v.queue = q
+	v.elem = s.queues[q].PushFront(v)
+	s.sizes[q] += v.size()
+}
+
+func (s *S3FIFO) unlink(v *value) {
+	s.queues[v.queue].Remove(v.elem)
+	s.sizes[v.queue] -= v.size()
+}
+
+func (s *S3FIFO) remove(v *value) {
+	s.unlink(v)
+	delete(s.values, v.key)
+}
@@ -0,0 +1,88 @@
+package s3fifo
+
+import (
+	"context"
+	"strconv"
+	"testing"
+)
+
+// set adds a 100 byte entry for key, which must be 2 bytes long.
+func set(s *S3FIFO, key string) {
+	_ = s.Set(context.Background(), key, make([]byte, 98), 0)
+}
+
+func TestS3FIFOPromotion(t *testing.T) {
+	ctx := context.Background()
+	s := New(1000)
+	set(s, "k0")
+	_, _, _ = s.Get(ctx, "k0")
+	for i := 1; i < 10; i++ {
+		set(s, "k"+strconv.Itoa(i))
+	}
+
+	// The oldest value was accessed in the small queue, so it moves to the
+	// main queue, and the next oldest is evicted to the ghost queue.
+	set(s, "ka")
+	if v := s.values["k0"]; v == nil || v.queue != main || v.freq != 0 {
+		t.Fatalf("expected k0 to be promoted to main: %+v", v)
+	}
+	if _, ok := s.values["k1"]; ok {
+		t.Fatal("expected k1 to be evicted")
+	}
+	if _, ok := s.ghostIndex["k1"]; !ok {
+		t.Fatal("expected k1 to be in the ghost queue")
+	}
+	if s.Size() != 1000 || s.Evictions() != 1 {
+		t.Fatalf("unexpected size %d with %d evictions", s.Size(), s.Evictions())
+	}
+
+	// Setting a key in the ghost queue admits it straight to main.
+	set(s, "k1")
+	if v := s.values["k1"]; v == nil || v.queue != main {
+		t.Fatalf("expected k1 to be readmitted to main: %+v", v)
+	}
+	if _, ok := s.ghostIndex["k1"]; ok {
+		t.Fatal("expected k1 to be removed from the ghost queue")
+	}
+}
+
+func TestS3FIFOMainReinsertion(t *testing.T) {
+	ctx := context.Background()
+	s := New(1000)
+	for _, key := range []string{"k0", "k1", "k2"} {
+		set(s, key)
+		s.unlink(s.values[key])
+		s.push(s.values[key], main)
+	}
+	_, _, _ = s.Get(ctx, "k0")
+	_, _, _ = s.Get(ctx, "k0")
+
+	// The oldest value has been accessed, so it's reinserted with one fewer
+	// access, and the next oldest is evicted instead.
+	s.evictMain()
+	if _, ok := s.values["k1"]; ok {
+		t.Fatal("expected k1 to be evicted")
+	}
+	v := s.values["k0"]
+	if v == nil || v.freq != 1 || s.queues[main].Front().Value != v {
+		t.Fatalf("expected k0 to be reinserted: %+v", v)
+	}
+
+	// Main values aren't remembered in the ghost queue.
+	if _, ok := s.ghostIndex["k1"]; ok {
+		t.Fatal("unexpected ghost for value evicted from main")
+	}
+}
+
+func TestS3FIFOGhostBudget(t *testing.T) {
+	s := New(1000)
+	for i := 10; i < 100; i++ {
+		set(s, strconv.Itoa(i))
+		if s.ghostSize > s.maxBytes-s.smallBytes {
+			t.Fatalf("ghost queue exceeds budget: %d", s.ghostSize)
+		}
+	}
+	if s.ghosts.Len() != len(s.ghostIndex) || s.ghosts.Len() != 9 {
+		t.Fatalf("unexpected ghost queue length: %d", s.ghosts.Len())
+	}
+}
@@ -0,0 +1,91 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2020 Ryan Fowler
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package distcache
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// storeTTL returns the TTL that a value should be stored with, given the TTL
+// returned by the Getter.
+func (c *Cache) storeTTL(ttl time.Duration) time.Duration {
+	if ttl == 0 {
+		ttl = c.softTTL
+	}
+	if ttl > 0 {
+		ttl += c.staleTTL
+	}
+	return ttl
+}
+
+// isStale returns true if a value with the remaining ttl is no longer fresh.
+func (c *Cache) isStale(ttl time.Duration) bool {
+	return c.staleTTL > 0 && ttl > 0 && ttl <= c.staleTTL
+}
+
+// checkFreshness marks a result from the local stores as stale if necessary,
+// starting a background refresh if it's stale or about to become stale.
+func (c *Cache) checkFreshness(ctx context.Context, key string, res Result) Result {
+	if res.TTL <= 0 {
+		return res
+	}
+	if c.isStale(res.TTL) {
+		c.refresh(ctx, key, res.Source)
+		res.Source = ResultStale
+		return res
+	}
+	if c.refreshAhead > 0 && res.TTL-c.staleTTL <= c.refreshAhead {
+		c.refresh(ctx, key, res.Source)
+	}
+	return res
+}
+
+// refresh reloads the value for key in the background, writing it to the store
+// that the old value was found in. Only one refresh runs per key at a time.
+func (c *Cache) refresh(ctx context.Context, key string, src ResultSource) {
+	// The refresh outlives the caller, so it's never released, and only ends
+	// when it completes or times out.
+	c.refreshing.DoChan(ctx, key, func(ctx context.Context) (interface{}, error) {
+		ctx = c.deletions.startLoad(ctx)
+		res, err := c.load(ctx, key)
+		c.observe(ctx, RefreshEvent{Key: key, Err: err})
+		if errors.Is(err, ErrNotFound) {
+			// The key no longer exists, so stop serving the old value.
+			_ = c.storeDelete(ctx, StoreHot, key)
+			_ = c.storeDelete(ctx, StoreLocal, key)
+			return nil, err
+		}
+		if err != nil || res.Source == ResultStale || c.deletions.deletedSince(ctx, key) {
+			return nil, err
+		}
+		switch src {
+		case ResultHotCache:
+			_ = c.storeSet(ctx, StoreHot, key, res.Value, res.TTL)
+		case ResultLocalCache:
+			_ = c.storeSet(ctx, StoreLocal, key, res.Value, res.TTL)
+		}
+		return nil, nil
+	})
+}
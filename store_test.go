@@ -0,0 +1,182 @@
+package distcache_test
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"math/rand/v2"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ryanfowler/distcache"
+	"github.com/ryanfowler/distcache/arc"
+	"github.com/ryanfowler/distcache/lru"
+	"github.com/ryanfowler/distcache/s3fifo"
+	"github.com/ryanfowler/distcache/tinylfu"
+)
+
+var traceFile = flag.String("trace", "", "file of keys, one access per line, to replay in TestSimulator")
+
+type sizedStore interface {
+	distcache.Store
+	Len() int
+	Size() int
+	Evictions() uint64
+	Range(fn func(key string, val []byte) bool)
+}
+
+var stores = []struct {
+	name string
+	new  func(maxBytes int) sizedStore
+}{
+	{"lru", func(n int) sizedStore { return lru.New(n) }},
+	{"sharded-lru", func(n int) sizedStore { return lru.NewSharded(16, n) }},
+	{"tinylfu", func(n int) sizedStore { return tinylfu.New(n) }},
+	{"s3fifo", func(n int) sizedStore { return s3fifo.New(n) }},
+	{"arc", func(n int) sizedStore { return arc.New(n) }},
+}
+
+func TestStores(t *testing.T) {
+	ctx := context.Background()
+	for _, tc := range stores {
+		t.Run(tc.name, func(t *testing.T) {
+			const maxBytes = 64 << 10
+			store := tc.new(maxBytes)
+
+			_ = store.Set(ctx, "key", []byte("value"), time.Minute)
+			val, ttl, err := store.Get(ctx, "key")
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err.Error())
+			}
+			if string(val) != "value" || ttl <= 0 || ttl > time.Minute {
+				t.Fatalf("unexpected result: %q %s", val, ttl)
+			}
+			_ = store.Set(ctx, "key", []byte("replaced"), 0)
+			if val, ttl, _ = store.Get(ctx, "key"); string(val) != "replaced" || ttl != 0 {
+				t.Fatalf("unexpected result after replace: %q %s", val, ttl)
+			}
+			if store.Size() != len("key")+len("replaced") {
+				t.Fatalf("unexpected size: %d", store.Size())
+			}
+			_ = store.Set(ctx, "key", []byte("expired"), -1)
+			if val, _, _ = store.Get(ctx, "key"); val != nil {
+				t.Fatalf("unexpected value after expiry: %q", val)
+			}
+			_ = store.Set(ctx, "key", []byte("value"), 0)
+			_ = store.Delete(ctx, "key")
+			if val, _, _ = store.Get(ctx, "key"); val != nil {
+				t.Fatalf("unexpected value after delete: %q", val)
+			}
+			_ = store.Set(ctx, "huge", make([]byte, maxBytes+1), 0)
+			if val, _, _ = store.Get(ctx, "huge"); val != nil {
+				t.Fatal("unexpected value larger than the store")
+			}
+
+			// Fill the store well past its budget, reading some keys back.
+			for i := 0; i < 10000; i++ {
+				key := strconv.Itoa(i)
+				_ = store.Set(ctx, key, make([]byte, 100), 0)
+				if i%3 == 0 {
+					_, _, _ = store.Get(ctx, strconv.Itoa(i/2))
+				}
+				if store.Size() > maxBytes {
+					t.Fatalf("store exceeded budget: %d", store.Size())
+				}
+			}
+			if store.Evictions() == 0 {
+				t.Fatal("expected evictions")
+			}
+			var keys []string
+			var size int
+			store.Range(func(key string, val []byte) bool {
+				keys = append(keys, key)
+				size += len(key) + len(val)
+				return true
+			})
+			if len(keys) != store.Len() || size != store.Size() {
+				t.Fatalf("unexpected range: %d entries, %d bytes (len %d, size %d)", len(keys), size, store.Len(), store.Size())
+			}
+			for _, key := range keys {
+				if val, _, _ := store.Get(ctx, key); val == nil {
+					t.Fatalf("ranged key %q not found", key)
+				}
+			}
+		})
+	}
+}
+
+// TestSimulator replays a key access trace against each store, reporting hit
+// ratios. Pass -trace to replay a real access log; otherwise a synthetic
+// trace of a skewed working set interrupted by scans of unique keys is used.
+func TestSimulator(t *testing.T) {
+	trace := syntheticTrace()
+	if *traceFile != "" {
+		var err error
+		if trace, err = readTrace(*traceFile); err != nil {
+			t.Fatalf("unable to read trace: %s", err.Error())
+		}
+	}
+
+	ctx := context.Background()
+	val := make([]byte, 100)
+	ratios := make(map[string]float64)
+	for _, tc := range stores {
+		store := tc.new(1000 * (len(val) + 8))
+		var hits int
+		for _, key := range trace {
+			if v, _, _ := store.Get(ctx, key); v != nil {
+				hits++
+				continue
+			}
+			_ = store.Set(ctx, key, val, 0)
+		}
+		ratios[tc.name] = float64(hits) / float64(len(trace))
+		t.Logf("%-12s hit ratio: %.2f%%", tc.name, 100*ratios[tc.name])
+	}
+
+	if *traceFile == "" {
+		for _, name := range []string{"tinylfu", "s3fifo", "arc"} {
+			if ratios[name] <= ratios["lru"] {
+				t.Errorf("%s hit ratio is not better than lru on a scan: %.4f <= %.4f", name, ratios[name], ratios["lru"])
+			}
+		}
+	}
+}
+
+// syntheticTrace returns accesses to a Zipf-distributed working set of 10,000
+// keys, with a scan of 5,000 unique keys after every 20,000 accesses.
+func syntheticTrace() []string {
+	rng := rand.New(rand.NewPCG(1, 2))
+	zipf := rand.NewZipf(rng, 1.1, 1, 9999)
+	var trace []string
+	var scanned int
+	for i := 0; i < 200000; i++ {
+		trace = append(trace, "key"+strconv.FormatUint(zipf.Uint64(), 10))
+		if i%20000 == 19999 {
+			for j := 0; j < 5000; j++ {
+				trace = append(trace, "scan"+strconv.Itoa(scanned))
+				scanned++
+			}
+		}
+	}
+	return trace
+}
+
+func readTrace(name string) ([]string, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var trace []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if key := strings.TrimSpace(scanner.Text()); key != "" {
+			trace = append(trace, key)
+		}
+	}
+	return trace, scanner.Err()
+}
@@ -0,0 +1,316 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2020 Ryan Fowler
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+// Package tinylfu implements a byte-budgeted store using the W-TinyLFU
+// eviction policy.
+package tinylfu
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"time"
+
+	"github.com/ryanfowler/distcache"
+	"github.com/ryanfowler/distcache/internal/sketch"
+)
+
+var _ distcache.Store = (*TinyLFU)(nil)
+
+const (
+	// windowPercent is the share of the budget used by the admission window.
+	windowPercent = 1
+	// protectedPercent is the share of the main space used by the protected
+	// segment.
+	protectedPercent = 80
+	// avgEntrySize is the entry size assumed when sizing the frequency
+	// sketch.
+	avgEntrySize  = 256
+	maxSketchSize = 1 << 22
+)
+
+type segment int
+
+const (
+	window segment = iota
+	probation
+	protected
+)
+
+// TinyLFU is a store that admits new values to a small LRU window, and only
+// moves them into the main space, a segmented LRU, if they are accessed more
+// often than the value that would be evicted for them. This keeps values that
+// are read once, such as by scans, from flushing the working set.
+type TinyLFU struct {
+	maxBytes       int
+	windowBytes    int
+	protectedBytes int
+	now            func() time.Time
+
+	mu        sync.Mutex
+	sketch    *sketch.CountMin
+	lists     [3]*list.List
+	sizes     [3]int
+	evictions uint64
+	values    map[string]*value
+}
+
+type value struct {
+	key     string
+	val     []byte
+	hash    uint64
+	expires time.Time
+	segment segment
+	elem    *list.Element
+}
+
+func (v *value) size() int {
+	return len(v.key) + len(v.val)
+}
+
+func (v *value) expired(now time.Time) bool {
+	return !v.expires.IsZero() && !now.Before(v.expires)
+}
+
+// New returns a TinyLFU that holds up to maxBytes of keys and values.
+func New(maxBytes int) *TinyLFU {
+	windowBytes := maxBytes * windowPercent / 100
+	t := &TinyLFU{
+		maxBytes:       maxBytes,
+		windowBytes:    windowBytes,
+		protectedBytes: (maxBytes - windowBytes) * protectedPercent / 100,
+		now:            time.Now,
+		sketch:         sketch.New(min(max(maxBytes/avgEntrySize, 1), maxSketchSize)),
+		values:         make(map[string]*value),
+	}
+	for i := range t.lists {
+		t.lists[i] = list.New()
+	}
+	return t
+}
+
+func (t *TinyLFU) Get(ctx context.Context, key string) ([]byte, time.Duration, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	v, ok := t.values[key]
+	if !ok {
+		t.sketch.Add(t.sketch.Hash(key))
+		return nil, 0, nil
+	}
+	t.sketch.Add(v.hash)
+	var ttl time.Duration
+	if !v.expires.IsZero() {
+		now := t.now()
+		if v.expired(now) {
+			t.remove(v)
+			return nil, 0, nil
+		}
+		ttl = v.expires.Sub(now)
+	}
+	t.touch(v)
+	return v.val, ttl, nil
+}
+
+func (t *TinyLFU) Len() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.values)
+}
+
+func (t *TinyLFU) Size() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.sizes[window] + t.sizes[probation] + t.sizes[protected]
+}
+
+// Evictions returns the number of values that have been evicted or rejected
+// to stay within maxBytes.
+func (t *TinyLFU) Evictions() uint64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.evictions
+}
+
+// Range calls fn for each value, from the protected segment to the window.
+func (t *TinyLFU) Range(fn func(key string, val []byte) bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := t.now()
+	for _, seg := range []segment{protected, probation, window} {
+		for e := t.lists[seg].Front(); e != nil; e = e.Next() {
+			v := e.Value.(*value)
+			if v.expired(now) {
+				continue
+			}
+			if !fn(v.key, v.val) {
+				return
+			}
+		}
+	}
+}
+
+func (t *TinyLFU) Set(ctx context.Context, key string, val []byte, ttl time.Duration) error {
+	if val == nil {
+		return nil
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	v, ok := t.values[key]
+	if ttl < 0 || len(key)+len(val) > t.maxBytes {
+		// The value has already expired, or can never fit.
+		if ok {
+			t.remove(v)
+		}
+		return nil
+	}
+
+	var expires time.Time
+	if ttl > 0 {
+		expires = t.now().Add(ttl)
+	}
+
+	if ok {
+		t.sizes[v.segment] += len(val) - len(v.val)
+		v.val = val
+		v.expires = expires
+		t.touch(v)
+	} else {
+		v = &value{key: key, val: val, hash: t.sketch.Hash(key), expires: expires}
+		t.push(v, window)
+		t.values[key] = v
+	}
+
+	t.evict()
+	return nil
+}
+
+func (t *TinyLFU) Delete(ctx context.Context, key string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if v, ok := t.values[key]; ok {
+		t.remove(v)
+	}
+	return nil
+}
+
+// touch records an access to v, promoting it from probation to protected.
+func (t *TinyLFU) touch(v *value) {
+	if v.segment != probation {
+		t.lists[v.segment].MoveToFront(v.elem)
+		return
+	}
+	t.unlink(v)
+	t.push(v, protected)
+	t.demote()
+}
+
+// demote moves the least recently used protected values to probation to keep
+// the protected segment within its share of the main space.
+func (t *TinyLFU) demote() {
+	for t.sizes[protected] > t.protectedBytes {
+		v := t.lists[protected].Back().Value.(*value)
+		t.unlink(v)
+		t.push(v, probation)
+	}
+}
+
+// evict moves values out of the window while it's over budget, admitting
+// each to the main space only if it's estimated to be accessed more often
+// than the values it would replace.
+func (t *TinyLFU) evict() {
+	// Replacing protected values can grow them past their budget.
+	t.demote()
+
+	mainBytes := t.maxBytes - t.windowBytes
+	for t.sizes[window] > t.windowBytes {
+		candidate := t.lists[window].Back().Value.(*value)
+		t.unlink(candidate)
+		if t.admit(candidate, mainBytes) {
+			t.push(candidate, probation)
+		} else {
+			delete(t.values, candidate.key)
+			t.evictions++
+		}
+	}
+
+	// Replacing values in the main space can grow it past its budget.
+	for t.sizes[probation]+t.sizes[protected] > mainBytes {
+		t.remove(t.victim())
+		t.evictions++
+	}
+}
+
+// admit returns whether candidate should be moved into the main space,
+// evicting values from the main space to make room for it. The values that
+// would be evicted are all compared with the candidate before any of them are
+// removed, so a rejected candidate never costs the main space any values.
+func (t *TinyLFU) admit(candidate *value, mainBytes int) bool {
+	if candidate.size() > mainBytes {
+		return false
+	}
+	freq := t.sketch.Estimate(candidate.hash)
+	need := t.sizes[probation] + t.sizes[protected] + candidate.size() - mainBytes
+	var victims []*value
+	for _, seg := range []segment{probation, protected} {
+		for e := t.lists[seg].Back(); e != nil && need > 0; e = e.Prev() {
+			victim := e.Value.(*value)
+			if freq <= t.sketch.Estimate(victim.hash) {
+				return false
+			}
+			victims = append(victims, victim)
+			need -= victim.size()
+		}
+	}
+	for _, victim := range victims {
+		t.remove(victim)
+		t.evictions++
+	}
+	return true
+}
+
+// victim returns the value that would be evicted next from the main space.
+func (t *TinyLFU) victim() *value {
+	for _, seg := range []segment{probation, protected} {
+		if e := t.lists[seg].Back(); e != nil {
+			return e.Value.(*value)
+		}
+	}
+	return nil
+}
+
+func (t *TinyLFU) push(v *value, seg segment) {
+	v.segment = seg
+	v.elem = t.lists[seg].PushFront(v)
+	t.sizes[seg] += v.size()
+}
+
+func (t *TinyLFU) unlink(v *value) {
+	t.lists[v.segment].Remove(v.elem)
+	t.sizes[v.segment] -= v.size()
+}
+
+func (t *TinyLFU) remove(v *value) {
+	t.unlink(v)
+	delete(t.values, v.key)
+}
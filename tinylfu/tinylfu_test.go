@@ -0,0 +1,80 @@
+package tinylfu
+
+import (
+	"context"
+	"testing"
+)
+
+func TestTinyLFURejectedAdmission(t *testing.T) {
+	ctx := context.Background()
+	tl := New(100000)
+	val := make([]byte, 32999)
+
+	// Fill the main space with one rarely used value on probation and two
+	// frequently used values that are protected.
+	for _, key := range []string{"a", "b", "c"} {
+		_ = tl.Set(ctx, key, val, 0)
+	}
+	for i := 0; i < 5; i++ {
+		_, _, _ = tl.Get(ctx, "b")
+		_, _, _ = tl.Get(ctx, "c")
+	}
+
+	// The candidate is used more often than the first value that it would
+	// evict, but not the second, so it's rejected without evicting either.
+	for i := 0; i < 3; i++ {
+		_, _, _ = tl.Get(ctx, "d")
+	}
+	_ = tl.Set(ctx, "d", make([]byte, 59999), 0)
+	for _, key := range []string{"a", "b", "c"} {
+		if v, ok := tl.values[key]; !ok || v.segment == window {
+			t.Fatalf("expected %q to remain in the main space", key)
+		}
+	}
+	if _, ok := tl.values["d"]; ok {
+		t.Fatal("expected candidate to be rejected")
+	}
+	if n := tl.Evictions(); n != 1 {
+		t.Fatalf("unexpected number of evictions: %d", n)
+	}
+}
+
+func TestTinyLFUSegments(t *testing.T) {
+	ctx := context.Background()
+	tl := New(100000)
+
+	// New values start in the window, and move to probation once it's full.
+	_ = tl.Set(ctx, "a", make([]byte, 400), 0)
+	if seg := tl.values["a"].segment; seg != window {
+		t.Fatalf("unexpected segment for new value: %d", seg)
+	}
+	_ = tl.Set(ctx, "b", make([]byte, 700), 0)
+	if seg := tl.values["a"].segment; seg != probation {
+		t.Fatalf("expected value to move to probation: %d", seg)
+	}
+	if seg := tl.values["b"].segment; seg != window {
+		t.Fatalf("unexpected segment for new value: %d", seg)
+	}
+
+	// Accessing a value on probation protects it.
+	_, _, _ = tl.Get(ctx, "a")
+	if seg := tl.values["a"].segment; seg != protected {
+		t.Fatalf("expected value to be protected: %d", seg)
+	}
+
+	// Protected values are demoted to probation, least recently used first,
+	// once the protected segment is over budget.
+	for _, key := range []string{"c", "d"} {
+		_ = tl.Set(ctx, key, make([]byte, 39500), 0)
+		_, _, _ = tl.Get(ctx, key)
+	}
+	if seg := tl.values["a"].segment; seg != probation {
+		t.Fatalf("expected value to be demoted: %d", seg)
+	}
+	if tl.values["c"].segment != protected || tl.values["d"].segment != protected {
+		t.Fatal("expected recently used values to stay protected")
+	}
+	if tl.sizes[protected] > tl.protectedBytes {
+		t.Fatalf("protected segment over budget: %d", tl.sizes[protected])
+	}
+}
@@ -0,0 +1,98 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2020 Ryan Fowler
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package distcache
+
+import (
+	"context"
+	"hash/crc32"
+	"strconv"
+)
+
+// Tracer creates spans for each stage of retrieving a key, and propagates
+// trace context to peers. It's intended to be a thin adapter over an
+// OpenTelemetry tracer and text map propagator.
+type Tracer interface {
+	// Start returns a new span that's a child of any span in ctx, and a
+	// context containing it.
+	Start(ctx context.Context, name string) (context.Context, Span)
+	// Inject writes the trace context in ctx to carrier.
+	Inject(ctx context.Context, carrier map[string]string)
+	// Extract returns a copy of ctx containing the trace context read from
+	// carrier.
+	Extract(ctx context.Context, carrier map[string]string) context.Context
+}
+
+type Span interface {
+	SetAttributes(attrs ...Attribute)
+	RecordError(err error)
+	End()
+}
+
+type Attribute struct {
+	Key   string
+	Value string
+}
+
+// The attributes set on spans. Keys are hashed, rather than included as-is,
+// so that their contents aren't exported.
+const (
+	AttrKeyHash      = "distcache.key_hash"
+	AttrKeyCount     = "distcache.key_count"
+	AttrPeer         = "distcache.peer"
+	AttrResultSource = "distcache.result_source"
+	AttrStore        = "distcache.store"
+)
+
+// KeyHash returns the hash of key used for the AttrKeyHash attribute.
+func KeyHash(key string) string {
+	return strconv.FormatUint(uint64(crc32.ChecksumIEEE([]byte(key))), 16)
+}
+
+type noopSpan struct{}
+
+func (noopSpan) SetAttributes(...Attribute) {}
+func (noopSpan) RecordError(error)          {}
+func (noopSpan) End()                       {}
+
+// startSpan starts a span for an operation on keys, or returns a no-op span
+// if no Tracer is configured.
+func (c *Cache) startSpan(ctx context.Context, name string, keys ...string) (context.Context, Span) {
+	if c.tracer == nil {
+		return ctx, noopSpan{}
+	}
+	ctx, span := c.tracer.Start(ctx, name)
+	if len(keys) == 1 {
+		span.SetAttributes(Attribute{Key: AttrKeyHash, Value: KeyHash(keys[0])})
+	} else {
+		span.SetAttributes(Attribute{Key: AttrKeyCount, Value: strconv.Itoa(len(keys))})
+	}
+	return ctx, span
+}
+
+// endSpan records err, if any, and ends span.
+func endSpan(span Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+	}
+	span.End()
+}
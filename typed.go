@@ -0,0 +1,237 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2020 Ryan Fowler
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package distcache
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"hash/maphash"
+	"sync"
+	"time"
+)
+
+// Codec converts values of type T to and from bytes.
+type Codec[T any] interface {
+	Marshal(v T) ([]byte, error)
+	Unmarshal(data []byte) (T, error)
+}
+
+// JSONCodec returns a Codec that uses encoding/json.
+func JSONCodec[T any]() Codec[T] {
+	return jsonCodec[T]{}
+}
+
+type jsonCodec[T any] struct{}
+
+func (jsonCodec[T]) Marshal(v T) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonCodec[T]) Unmarshal(data []byte) (T, error) {
+	var v T
+	err := json.Unmarshal(data, &v)
+	return v, err
+}
+
+// GobCodec returns a Codec that uses encoding/gob. Each value is encoded with
+// its own type information, so it can be decoded independently.
+func GobCodec[T any]() Codec[T] {
+	return gobCodec[T]{}
+}
+
+type gobCodec[T any] struct{}
+
+func (gobCodec[T]) Marshal(v T) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (gobCodec[T]) Unmarshal(data []byte) (T, error) {
+	var v T
+	err := gob.NewDecoder(bytes.NewReader(data)).Decode(&v)
+	return v, err
+}
+
+// TypedGetterFunc is a GetterFunc that returns values of type T.
+type TypedGetterFunc[T any] func(ctx context.Context, key string) (T, time.Duration, error)
+
+// Getter returns a Getter that encodes the values returned by tgf with codec.
+func (tgf TypedGetterFunc[T]) Getter(codec Codec[T]) Getter {
+	return GetterFunc(func(ctx context.Context, key string) ([]byte, time.Duration, error) {
+		v, ttl, err := tgf(ctx, key)
+		if err != nil {
+			return nil, 0, err
+		}
+		data, err := codec.Marshal(v)
+		return data, ttl, err
+	})
+}
+
+// TypedOptions configures a Typed cache.
+type TypedOptions struct {
+	// MemoSize, if non-zero, is the number of decoded values to keep, so
+	// that getting a key whose value hasn't changed doesn't decode it
+	// again. Memoized values are matched to the current value by a hash of
+	// its bytes, expire with its TTL, and are shared between callers, so
+	// they must not be modified.
+	MemoSize int
+}
+
+// Typed wraps a Cache, decoding its values as type T.
+type Typed[T any] struct {
+	cache *Cache
+	codec Codec[T]
+	memo  *memo[T]
+}
+
+// NewTyped returns a Typed that decodes the values of cache with codec.
+func NewTyped[T any](cache *Cache, codec Codec[T], opts TypedOptions) *Typed[T] {
+	t := &Typed[T]{cache: cache, codec: codec}
+	if opts.MemoSize > 0 {
+		t.memo = newMemo[T](opts.MemoSize)
+	}
+	return t
+}
+
+func (t *Typed[T]) Get(ctx context.Context, key string) (T, ResultSource, error) {
+	res, err := t.cache.GetResult(ctx, key)
+	if err != nil {
+		var zero T
+		return zero, ResultNone, err
+	}
+	v, err := t.decode(key, res)
+	return v, res.Source, err
+}
+
+// GetMulti is like Cache.GetMulti, decoding each value. Values that fail to
+// decode are reported in the returned KeyErrors. Nil values, such as for keys
+// missing from a BatchGetter's results, are returned as the zero value.
+func (t *Typed[T]) GetMulti(ctx context.Context, keys []string) (map[string]T, error) {
+	results, err := t.cache.GetMulti(ctx, keys)
+	var errs KeyErrors
+	if err != nil && !errors.As(err, &errs) {
+		return nil, err
+	}
+	values := make(map[string]T, len(results))
+	for key, res := range results {
+		v, err := t.decode(key, res)
+		if err != nil {
+			errs = errs.add(key, err)
+			continue
+		}
+		values[key] = v
+	}
+	return values, errs.orNil()
+}
+
+func (t *Typed[T]) decode(key string, res Result) (T, error) {
+	if res.Value == nil {
+		var zero T
+		return zero, nil
+	}
+	if t.memo == nil {
+		return t.codec.Unmarshal(res.Value)
+	}
+	hash := maphash.Bytes(t.memo.seed, res.Value)
+	if v, ok := t.memo.get(key, hash); ok {
+		return v, nil
+	}
+	v, err := t.codec.Unmarshal(res.Value)
+	if err == nil {
+		t.memo.set(key, hash, res.TTL, v)
+	}
+	return v, err
+}
+
+// memo is an LRU of decoded values. Each value is only used for the same key
+// and bytes that it was decoded from, and is kept no longer than their TTL.
+type memo[T any] struct {
+	seed maphash.Seed
+	now  func() time.Time
+
+	mu      sync.Mutex
+	size    int
+	ll      *list.List
+	entries map[string]*list.Element
+}
+
+type memoEntry[T any] struct {
+	key     string
+	hash    uint64
+	expires time.Time
+	val     T
+}
+
+func newMemo[T any](size int) *memo[T] {
+	return &memo[T]{
+		seed:    maphash.MakeSeed(),
+		now:     time.Now,
+		size:    size,
+		ll:      list.New(),
+		entries: make(map[string]*list.Element),
+	}
+}
+
+func (m *memo[T]) get(key string, hash uint64) (T, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if e, ok := m.entries[key]; ok {
+		entry := e.Value.(*memoEntry[T])
+		if !entry.expires.IsZero() && !m.now().Before(entry.expires) {
+			m.ll.Remove(e)
+			delete(m.entries, key)
+		} else if entry.hash == hash {
+			m.ll.MoveToFront(e)
+			return entry.val, true
+		}
+	}
+	var zero T
+	return zero, false
+}
+
+func (m *memo[T]) set(key string, hash uint64, ttl time.Duration, val T) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	entry := &memoEntry[T]{key: key, hash: hash, val: val}
+	if ttl > 0 {
+		entry.expires = m.now().Add(ttl)
+	}
+	if e, ok := m.entries[key]; ok {
+		e.Value = entry
+		m.ll.MoveToFront(e)
+		return
+	}
+	m.entries[key] = m.ll.PushFront(entry)
+	if m.ll.Len() > m.size {
+		oldest := m.ll.Back()
+		m.ll.Remove(oldest)
+		delete(m.entries, oldest.Value.(*memoEntry[T]).key)
+	}
+}
@@ -0,0 +1,61 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2020 Ryan Fowler
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package distcache
+
+import "io"
+
+// rangerFunc is a Ranger backed by a function.
+type rangerFunc func(fn func(key string, val []byte) bool)
+
+func (rf rangerFunc) Range(fn func(key string, val []byte) bool) {
+	rf(fn)
+}
+
+// wrapStore returns wrapper, a Store wrapping store, extended to be a Ranger
+// using rangeFn if store is a Ranger, and an io.Closer that closes store if
+// store is an io.Closer. This keeps type assertions on the wrapper as
+// truthful as they are on store.
+func wrapStore(store, wrapper Store, rangeFn rangerFunc) Store {
+	_, isRanger := store.(Ranger)
+	closer, isCloser := store.(io.Closer)
+	switch {
+	case isRanger && isCloser:
+		return struct {
+			Store
+			Ranger
+			io.Closer
+		}{wrapper, rangeFn, closer}
+	case isRanger:
+		return struct {
+			Store
+			Ranger
+		}{wrapper, rangeFn}
+	case isCloser:
+		return struct {
+			Store
+			io.Closer
+		}{wrapper, closer}
+	default:
+		return wrapper
+	}
+}